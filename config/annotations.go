@@ -0,0 +1,911 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+const (
+	// canaryServiceAnnotation names a service in the ingress's namespace that
+	// receives part of the traffic for every path of the ingress, on the same
+	// port as the path's own service.
+	canaryServiceAnnotation = "hing/canary-service"
+	// canaryWeightAnnotation is the percentage of traffic, from 0 to 100, sent
+	// to the canary service.
+	canaryWeightAnnotation = "hing/canary-weight"
+	// canaryByHeaderAnnotation and canaryByHeaderValueAnnotation send every
+	// request with the given header set to the given value to the canary.
+	canaryByHeaderAnnotation      = "hing/canary-by-header"
+	canaryByHeaderValueAnnotation = "hing/canary-by-header-value"
+	// canaryByCookieAnnotation sends every request with the named cookie to
+	// the canary.
+	canaryByCookieAnnotation = "hing/canary-by-cookie"
+
+	// affinityAnnotation enables session affinity for the ingress's paths.
+	// Only "cookie" is supported, which pins clients to a pod with a cookie
+	// inserted by HAProxy.
+	affinityAnnotation = "hing/affinity"
+	// sessionCookieNameAnnotation is the name of the affinity cookie,
+	// SERVERID by default.
+	sessionCookieNameAnnotation = "hing/session-cookie-name"
+	// sessionCookieMaxAgeAnnotation is how many seconds a client stays pinned
+	// to a pod after the cookie is first set.
+	sessionCookieMaxAgeAnnotation = "hing/session-cookie-max-age"
+	// sessionCookieFallbackAnnotation is what happens when a client's pod is
+	// down: "redispatch" (the default) sends it to another pod, "persist"
+	// keeps trying the pod.
+	sessionCookieFallbackAnnotation = "hing/session-cookie-fallback"
+
+	// authSecretAnnotation names a secret in the ingress's namespace whose
+	// "auth" key holds htpasswd style users. Requests for the ingress's paths
+	// must authenticate as one of them with HTTP basic authentication.
+	authSecretAnnotation = "hing/auth-secret"
+	// authRealmAnnotation is the realm presented to clients.
+	authRealmAnnotation = "hing/auth-realm"
+
+	// allowSourceRangeAnnotation and denySourceRangeAnnotation are comma
+	// separated lists of CIDRs or addresses. Requests to the ingress's paths
+	// from outside the allowed ranges, or from inside the denied ranges, are
+	// denied.
+	allowSourceRangeAnnotation = "hing/allow-source-range"
+	denySourceRangeAnnotation  = "hing/deny-source-range"
+
+	// limitRequestRateAnnotation is the number of requests per second, averaged
+	// over 10 seconds, that each client may make to a path of the ingress.
+	limitRequestRateAnnotation = "hing/limit-request-rate"
+	// limitConnectionsAnnotation is the number of concurrent connections each
+	// client may have open to a path of the ingress.
+	limitConnectionsAnnotation = "hing/limit-connections"
+	// limitByHeaderAnnotation identifies clients by the value of the named
+	// request header rather than by source address.
+	limitByHeaderAnnotation = "hing/limit-by-header"
+	// limitActionAnnotation is what happens to requests over the limits:
+	// "deny" (the default) responds immediately, "tarpit" holds the
+	// connection open first to slow the client down.
+	limitActionAnnotation = "hing/limit-action"
+	// limitStatusAnnotation is the status code for requests over the limits,
+	// 429 by default.
+	limitStatusAnnotation = "hing/limit-status"
+
+	// sslRedirectAnnotation redirects plain HTTP requests for the ingress's
+	// hosts to HTTPS. It defaults to true for hosts in the ingress's TLS
+	// section and false otherwise.
+	sslRedirectAnnotation = "hing/ssl-redirect"
+	// sslRedirectCodeAnnotation is the redirect's status code, 301 by default.
+	sslRedirectCodeAnnotation = "hing/ssl-redirect-code"
+	// hstsAnnotation adds a Strict-Transport-Security header to responses. Like
+	// the redirect, it defaults to true only for hosts in the TLS section.
+	hstsAnnotation = "hing/hsts"
+	// hstsMaxAgeAnnotation is the header's max-age in seconds, a year by
+	// default.
+	hstsMaxAgeAnnotation = "hing/hsts-max-age"
+	// hstsIncludeSubdomainsAnnotation and hstsPreloadAnnotation add the
+	// header's includeSubDomains and preload directives.
+	hstsIncludeSubdomainsAnnotation = "hing/hsts-include-subdomains"
+	hstsPreloadAnnotation           = "hing/hsts-preload"
+
+	// rewriteTargetAnnotation replaces the prefix each of the ingress's paths
+	// matched with the given path before the request is forwarded, so "/"
+	// strips it. The query string is left as it is.
+	rewriteTargetAnnotation = "hing/rewrite-target"
+
+	// The header annotations change the headers of requests sent to the
+	// ingress's backends and of responses returned to clients. The set and
+	// add annotations have a "Name: value" header on each line, and the delete
+	// annotations a header name on each line. A line may start with one of the
+	// ingress's paths, separated from the header by a space, to apply only to
+	// that path. Values may use the log-format variables in
+	// headerVariables.
+	setRequestHeadersAnnotation     = "hing/set-request-headers"
+	addRequestHeadersAnnotation     = "hing/add-request-headers"
+	deleteRequestHeadersAnnotation  = "hing/delete-request-headers"
+	setResponseHeadersAnnotation    = "hing/set-response-headers"
+	addResponseHeadersAnnotation    = "hing/add-response-headers"
+	deleteResponseHeadersAnnotation = "hing/delete-response-headers"
+
+	// enableCORSAnnotation makes HAProxy answer CORS preflight requests for
+	// the ingress's paths and add the Access-Control headers to responses.
+	enableCORSAnnotation = "hing/enable-cors"
+	// corsAllowOriginAnnotation is a comma separated list of the origins
+	// allowed, or "*", the default, for any.
+	corsAllowOriginAnnotation = "hing/cors-allow-origin"
+	// corsAllowMethodsAnnotation and corsAllowHeadersAnnotation are comma
+	// separated lists of the methods and headers allowed.
+	corsAllowMethodsAnnotation = "hing/cors-allow-methods"
+	corsAllowHeadersAnnotation = "hing/cors-allow-headers"
+	// corsAllowCredentialsAnnotation allows requests with credentials. It
+	// can't be used with any origin.
+	corsAllowCredentialsAnnotation = "hing/cors-allow-credentials"
+	// corsMaxAgeAnnotation is how many seconds clients may cache preflight
+	// responses for, a day by default.
+	corsMaxAgeAnnotation = "hing/cors-max-age"
+
+	// tunnelTimeoutAnnotation is how many seconds an upgraded connection,
+	// such as a WebSocket, may be idle before it's closed. It overrides the
+	// global default.
+	tunnelTimeoutAnnotation = "hing/tunnel-timeout"
+
+	// healthCheckAnnotation turns health checks off when "false". They're on
+	// by default, checking that the servers accept connections, or using
+	// the pods' readiness probe where it's an HTTP GET on the served port.
+	healthCheckAnnotation = "hing/health-check"
+	// healthCheckPathAnnotation checks servers with an HTTP request for the
+	// path. The method and expected status are in healthCheckMethodAnnotation,
+	// GET by default, and healthCheckStatusAnnotation, any 2xx or 3xx status
+	// by default.
+	healthCheckPathAnnotation   = "hing/health-check-path"
+	healthCheckMethodAnnotation = "hing/health-check-method"
+	healthCheckStatusAnnotation = "hing/health-check-status"
+	// healthCheckIntervalAnnotation is the seconds between checks, and
+	// healthCheckRiseAnnotation and healthCheckFallAnnotation are how many
+	// checks in a row mark a server up or down.
+	healthCheckIntervalAnnotation = "hing/health-check-interval"
+	healthCheckRiseAnnotation     = "hing/health-check-rise"
+	healthCheckFallAnnotation     = "hing/health-check-fall"
+
+	// errorPagesAnnotation is the name of a ConfigMap in the ingress's
+	// namespace with HTML pages for its 404, 502, 503 and 504 responses,
+	// keyed by status. They override the global ones.
+	errorPagesAnnotation = "hing/error-pages"
+
+	// customHTTPErrorsAnnotation is a comma separated list of the statuses
+	// whose responses are replaced by the service in errorServiceAnnotation,
+	// given as <service>:<port> in the ingress's namespace. Browsers' GET
+	// requests for pages are answered with a 302 to the error service, which
+	// is passed the status and request id. Other requests keep the original
+	// response, since API clients don't follow the redirect, and others only
+	// would as a GET, losing the status. Only the backend's responses can be
+	// replaced: the 502 and 504 HAProxy answers with when the backend fails
+	// or times out never reach the rules that redirect them.
+	customHTTPErrorsAnnotation = "hing/custom-http-errors"
+	errorServiceAnnotation     = "hing/error-service"
+
+	// externalNameAnnotation is set on a Service, rather than an ingress, to
+	// have it stand for the external host named, like a Service of type
+	// ExternalName, which the API doesn't have yet. Requests are sent to the
+	// host on the service's port, with it as their Host header, and over TLS
+	// if externalTLSAnnotation is "true".
+	externalNameAnnotation = "hing/external-name"
+	externalTLSAnnotation  = "hing/external-tls"
+)
+
+var (
+	validMethod    = regexp.MustCompile(`^[A-Z]+$`)
+	validCheckPath = regexp.MustCompile(`^/[A-Za-z0-9/._~%!&()*+,;=:@?-]*$`)
+)
+
+var (
+	validOrigin    = regexp.MustCompile(`^https?://[A-Za-z0-9.-]+(:[0-9]+)?$`)
+	validTokenList = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_|~-]+( *, *[A-Za-z0-9!#$%&'*+.^_|~-]+)*$")
+)
+
+// headerAnnotations are the header annotations in the order their rules are
+// rendered, with the rule each line becomes.
+var headerAnnotations = []struct {
+	name, rule string
+	values     bool
+}{
+	{deleteRequestHeadersAnnotation, "http-request del-header", false},
+	{setRequestHeadersAnnotation, "http-request set-header", true},
+	{addRequestHeadersAnnotation, "http-request add-header", true},
+	{deleteResponseHeadersAnnotation, "http-response del-header", false},
+	{setResponseHeadersAnnotation, "http-response set-header", true},
+	{addResponseHeadersAnnotation, "http-response add-header", true},
+}
+
+var (
+	// headerVariables are the log-format variables header values may use.
+	// Anything else, such as sample fetches, could fail to parse and take
+	// the whole config down with it.
+	headerVariables = regexp.MustCompile(`%(%|(Ts|ms|T|t|ci|cp|fi|fp|H|ID|pid|rt|b|f|s)\b)`)
+	// Header values are quoted in the config, so may have anything other
+	// than quotes, backslashes, control characters and "$", which HAProxy
+	// expands environment variables from inside quotes.
+	validQuotedValue = regexp.MustCompile(`^[^"\\$\x00-\x1f\x7f]*$`)
+)
+
+// Rewritten paths are kept to characters that need no escaping in the config or
+// in a regular expression, other than ".".
+var validRewritePath = regexp.MustCompile(`^/[A-Za-z0-9._~/-]*$`)
+
+// redirectCodes are the status codes HAProxy can redirect with.
+var redirectCodes = map[int]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+// denyStatuses are the status codes HAProxy can deny requests with.
+var denyStatuses = map[int]bool{200: true, 400: true, 403: true, 405: true, 408: true, 429: true, 500: true, 502: true, 503: true, 504: true}
+
+var (
+	// Header and cookie names are HTTP tokens, without "#", "$" and "'",
+	// which HAProxy reads as a comment, a variable and a quote.
+	validToken = regexp.MustCompile(`^[A-Za-z0-9!%&*+.^_|~-]+$`)
+	// Header values are kept to characters that need no quoting in the
+	// config.
+	validHeaderValue = regexp.MustCompile(`^[A-Za-z0-9._~:/=+-]+$`)
+)
+
+type canary struct {
+	Service string
+	Weight  int
+
+	Header, HeaderValue string
+	Cookie              string
+}
+
+// canaryFrom returns the canary configured by the ingress's annotations, or
+// nil if it has none.
+func canaryFrom(i extensions.Ingress) (*canary, error) {
+	service, ok := i.Annotations[canaryServiceAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	if !validServiceName.MatchString(service) {
+		return nil, fmt.Errorf("invalid %s: %q", canaryServiceAnnotation, service)
+	}
+
+	c := &canary{
+		Service:     service,
+		Header:      i.Annotations[canaryByHeaderAnnotation],
+		HeaderValue: i.Annotations[canaryByHeaderValueAnnotation],
+		Cookie:      i.Annotations[canaryByCookieAnnotation],
+	}
+
+	if c.Header != "" {
+		if !validToken.MatchString(c.Header) {
+			return nil, fmt.Errorf("invalid %s: %q", canaryByHeaderAnnotation, c.Header)
+		}
+		if !validHeaderValue.MatchString(c.HeaderValue) {
+			return nil, fmt.Errorf("invalid %s: %q", canaryByHeaderValueAnnotation, c.HeaderValue)
+		}
+	}
+
+	if c.Cookie != "" && !validToken.MatchString(c.Cookie) {
+		return nil, fmt.Errorf("invalid %s: %q", canaryByCookieAnnotation, c.Cookie)
+	}
+
+	weight, ok := i.Annotations[canaryWeightAnnotation]
+	if !ok {
+		if c.Header == "" && c.Cookie == "" {
+			return nil, fmt.Errorf("%s needs a weight, header or cookie", canaryServiceAnnotation)
+		}
+		return c, nil
+	}
+
+	var err error
+	c.Weight, err = strconv.Atoi(weight)
+	if err != nil || c.Weight < 0 || c.Weight > 100 {
+		return nil, fmt.Errorf("%s must be a percentage, got %q", canaryWeightAnnotation, weight)
+	}
+
+	return c, nil
+}
+
+// matchers returns the ACL matchers for requests forced to the canary.
+func (c *canary) matchers() []string {
+	if c == nil {
+		return nil
+	}
+
+	var m []string
+	if c.Header != "" {
+		m = append(m, fmt.Sprintf("req.hdr(%s) -m str %s", c.Header, c.HeaderValue))
+	}
+	if c.Cookie != "" {
+		m = append(m, fmt.Sprintf("req.cook(%s) -m found", c.Cookie))
+	}
+	return m
+}
+
+type affinity struct {
+	Cookie  string
+	MaxAge  int
+	Persist bool
+}
+
+// affinityFrom returns the session affinity configured by the ingress's
+// annotations, or nil if it has none.
+func affinityFrom(i extensions.Ingress) (*affinity, error) {
+	kind, ok := i.Annotations[affinityAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	if kind != "cookie" {
+		return nil, fmt.Errorf("unsupported %s: %q", affinityAnnotation, kind)
+	}
+
+	a := &affinity{Cookie: "SERVERID"}
+	if name, ok := i.Annotations[sessionCookieNameAnnotation]; ok {
+		if !validToken.MatchString(name) {
+			return nil, fmt.Errorf("invalid %s: %q", sessionCookieNameAnnotation, name)
+		}
+		a.Cookie = name
+	}
+
+	if maxAge, ok := i.Annotations[sessionCookieMaxAgeAnnotation]; ok {
+		var err error
+		a.MaxAge, err = strconv.Atoi(maxAge)
+		if err != nil || a.MaxAge <= 0 {
+			return nil, fmt.Errorf("%s must be a positive number of seconds, got %q", sessionCookieMaxAgeAnnotation, maxAge)
+		}
+	}
+
+	switch fallback := i.Annotations[sessionCookieFallbackAnnotation]; fallback {
+	case "", "redispatch":
+	case "persist":
+		a.Persist = true
+	default:
+		return nil, fmt.Errorf("unsupported %s: %q", sessionCookieFallbackAnnotation, fallback)
+	}
+
+	return a, nil
+}
+
+type auth struct {
+	Userlist, Realm string
+}
+
+// authFrom returns the name of the secret holding the users the ingress's
+// annotations require authentication against, and the realm to present to
+// clients. The secret name is empty if the ingress doesn't require
+// authentication.
+func authFrom(i extensions.Ingress) (secret, realm string, err error) {
+	secret = i.Annotations[authSecretAnnotation]
+	if secret == "" {
+		return "", "", nil
+	}
+
+	if !validSubdomain.MatchString(secret) {
+		return "", "", fmt.Errorf("invalid %s: %q", authSecretAnnotation, secret)
+	}
+
+	realm = i.Annotations[authRealmAnnotation]
+	if realm != "" && !validToken.MatchString(realm) {
+		return "", "", fmt.Errorf("invalid %s: %q", authRealmAnnotation, realm)
+	}
+
+	return secret, realm, nil
+}
+
+// sourceRangesFrom returns the source ranges the ingress's annotations allow
+// and deny.
+func sourceRangesFrom(i extensions.Ingress) (allow, deny []string, err error) {
+	allow, err = cidrs(allowSourceRangeAnnotation, i.Annotations[allowSourceRangeAnnotation])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deny, err = cidrs(denySourceRangeAnnotation, i.Annotations[denySourceRangeAnnotation])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return allow, deny, nil
+}
+
+// cidrs parses a comma separated list of CIDRs or addresses.
+func cidrs(annotation, list string) ([]string, error) {
+	var parsed []string
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(c); ip != nil {
+			parsed = append(parsed, ip.String())
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", annotation, c)
+		}
+		parsed = append(parsed, n.String())
+	}
+	return parsed, nil
+}
+
+type rateLimit struct {
+	// Type is the stick table type for Key, which identifies the client.
+	Type, Key string
+	// Requests is the number of requests allowed in 10 seconds.
+	Requests    int
+	Connections int
+	Action      string
+	Status      int
+}
+
+// rateLimitFrom returns the per client limits configured by the ingress's
+// annotations, or nil if it has none.
+func rateLimitFrom(i extensions.Ingress) (*rateLimit, error) {
+	rate, hasRate := i.Annotations[limitRequestRateAnnotation]
+	conns, hasConns := i.Annotations[limitConnectionsAnnotation]
+	if !hasRate && !hasConns {
+		return nil, nil
+	}
+
+	r := &rateLimit{Type: "ipv6", Key: "src", Action: "deny", Status: 429}
+	if hasRate {
+		perSecond, err := strconv.Atoi(rate)
+		if err != nil || perSecond <= 0 {
+			return nil, fmt.Errorf("%s must be a positive number, got %q", limitRequestRateAnnotation, rate)
+		}
+		r.Requests = perSecond * 10
+	}
+
+	if hasConns {
+		var err error
+		r.Connections, err = strconv.Atoi(conns)
+		if err != nil || r.Connections <= 0 {
+			return nil, fmt.Errorf("%s must be a positive number, got %q", limitConnectionsAnnotation, conns)
+		}
+	}
+
+	if header, ok := i.Annotations[limitByHeaderAnnotation]; ok {
+		if !validToken.MatchString(header) {
+			return nil, fmt.Errorf("invalid %s: %q", limitByHeaderAnnotation, header)
+		}
+		r.Type = "string len 64"
+		r.Key = fmt.Sprintf("req.hdr(%s)", header)
+	}
+
+	switch action := i.Annotations[limitActionAnnotation]; action {
+	case "", "deny":
+	case "tarpit":
+		r.Action = action
+	default:
+		return nil, fmt.Errorf("unsupported %s: %q", limitActionAnnotation, action)
+	}
+
+	if status, ok := i.Annotations[limitStatusAnnotation]; ok {
+		var err error
+		r.Status, err = strconv.Atoi(status)
+		if err != nil || !denyStatuses[r.Status] {
+			return nil, fmt.Errorf("unsupported %s: %q", limitStatusAnnotation, status)
+		}
+	}
+
+	return r, nil
+}
+
+// httpsFrom returns the status code to redirect plain HTTP requests for the
+// host to HTTPS with, and the Strict-Transport-Security header to add to its
+// responses. Either is empty if the ingress's annotations and TLS section
+// don't ask for it.
+func httpsFrom(i extensions.Ingress, host string) (redirectCode int, hsts string, err error) {
+	var tls bool
+	for _, t := range i.Spec.TLS {
+		for _, h := range t.Hosts {
+			tls = tls || h == host
+		}
+	}
+
+	redirect, err := boolAnnotation(i, sslRedirectAnnotation, tls)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if redirect {
+		redirectCode = 301
+		if code, ok := i.Annotations[sslRedirectCodeAnnotation]; ok {
+			redirectCode, err = strconv.Atoi(code)
+			if err != nil || !redirectCodes[redirectCode] {
+				return 0, "", fmt.Errorf("unsupported %s: %q", sslRedirectCodeAnnotation, code)
+			}
+		}
+	}
+
+	enabled, err := boolAnnotation(i, hstsAnnotation, tls)
+	if err != nil || !enabled {
+		return redirectCode, "", err
+	}
+
+	maxAge := 31536000
+	if age, ok := i.Annotations[hstsMaxAgeAnnotation]; ok {
+		maxAge, err = strconv.Atoi(age)
+		if err != nil || maxAge < 0 {
+			return 0, "", fmt.Errorf("%s must be a number of seconds, got %q", hstsMaxAgeAnnotation, age)
+		}
+	}
+	hsts = fmt.Sprintf("max-age=%d", maxAge)
+
+	if sub, err := boolAnnotation(i, hstsIncludeSubdomainsAnnotation, false); err != nil {
+		return 0, "", err
+	} else if sub {
+		hsts += "; includeSubDomains"
+	}
+
+	if preload, err := boolAnnotation(i, hstsPreloadAnnotation, false); err != nil {
+		return 0, "", err
+	} else if preload {
+		hsts += "; preload"
+	}
+
+	return redirectCode, hsts, nil
+}
+
+// boolAnnotation returns the value of the named boolean annotation, or def if
+// the ingress doesn't have it.
+func boolAnnotation(i extensions.Ingress, name string, def bool) (bool, error) {
+	v, ok := i.Annotations[name]
+	if !ok {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q", name, v)
+	}
+	return b, nil
+}
+
+// rewriteFrom returns the regsub arguments that rewrite the prefix matched by
+// path to the ingress's rewrite target, or an empty string if it has none.
+func rewriteFrom(i extensions.Ingress, path string) (string, error) {
+	target, ok := i.Annotations[rewriteTargetAnnotation]
+	if !ok {
+		return "", nil
+	}
+
+	if !validRewritePath.MatchString(target) {
+		return "", fmt.Errorf("invalid %s: %q", rewriteTargetAnnotation, target)
+	}
+
+	if !validRewritePath.MatchString(path) {
+		return "", fmt.Errorf("can't rewrite path %q", path)
+	}
+
+	// The prefix matches with or without its trailing slash, which the
+	// target always ends in so that the rest of the path stays separate.
+	// Dots, the only regex syntax paths can have, are left as they are:
+	// HAProxy ends the sample expression at the first "]", ruling out
+	// "[.]", and requests only reach the backend if their path starts with
+	// the prefix, so a dot can only match a dot anyway.
+	prefix := strings.TrimSuffix(path, "/")
+	if !strings.HasSuffix(target, "/") {
+		target += "/"
+	}
+
+	return fmt.Sprintf("^%s/?,%s", prefix, target), nil
+}
+
+// headerRulesFrom returns the header rules the ingress's annotations apply to
+// the path.
+func headerRulesFrom(i extensions.Ingress, path string) ([]string, error) {
+	var rules []string
+	for _, h := range headerAnnotations {
+		for _, line := range strings.Split(i.Annotations[h.name], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			if strings.HasPrefix(line, "/") {
+				parts := strings.SplitN(line, " ", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("invalid %s: %q", h.name, line)
+				}
+				if parts[0] != path {
+					continue
+				}
+				line = strings.TrimSpace(parts[1])
+			}
+
+			if !h.values {
+				if !validToken.MatchString(line) {
+					return nil, fmt.Errorf("invalid %s: %q", h.name, line)
+				}
+				rules = append(rules, fmt.Sprintf("%s %s", h.rule, line))
+				continue
+			}
+
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || !validToken.MatchString(parts[0]) {
+				return nil, fmt.Errorf("invalid %s: %q", h.name, line)
+			}
+
+			value := strings.TrimSpace(parts[1])
+			if !validQuotedValue.MatchString(value) || strings.Contains(headerVariables.ReplaceAllString(value, ""), "%") {
+				return nil, fmt.Errorf("invalid %s value for %s: %q", h.name, parts[0], value)
+			}
+			rules = append(rules, fmt.Sprintf("%s %s \"%s\"", h.rule, parts[0], value))
+		}
+	}
+	return rules, nil
+}
+
+type cors struct {
+	// Origins are the origins allowed, unless AnyOrigin is set.
+	Origins   []string
+	AnyOrigin bool
+
+	Methods, Headers string
+	Credentials      bool
+	MaxAge           int
+}
+
+// corsFrom returns the CORS settings in the ingress's annotations, or nil if
+// it doesn't enable CORS.
+func corsFrom(i extensions.Ingress) (*cors, error) {
+	enabled, err := boolAnnotation(i, enableCORSAnnotation, false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	c := &cors{
+		Methods: "GET, PUT, POST, DELETE, PATCH, OPTIONS",
+		Headers: "DNT, User-Agent, X-Requested-With, If-Modified-Since, Cache-Control, Content-Type, Range, Authorization",
+		MaxAge:  86400,
+	}
+
+	origins := i.Annotations[corsAllowOriginAnnotation]
+	if origins == "" || origins == "*" {
+		c.AnyOrigin = true
+	} else {
+		for _, o := range strings.Split(origins, ",") {
+			o = strings.TrimSpace(o)
+			if !validOrigin.MatchString(o) {
+				return nil, fmt.Errorf("invalid %s: %q", corsAllowOriginAnnotation, o)
+			}
+			c.Origins = append(c.Origins, o)
+		}
+	}
+
+	if methods, ok := i.Annotations[corsAllowMethodsAnnotation]; ok {
+		if !validTokenList.MatchString(methods) {
+			return nil, fmt.Errorf("invalid %s: %q", corsAllowMethodsAnnotation, methods)
+		}
+		c.Methods = methods
+	}
+
+	if headers, ok := i.Annotations[corsAllowHeadersAnnotation]; ok {
+		if !validTokenList.MatchString(headers) {
+			return nil, fmt.Errorf("invalid %s: %q", corsAllowHeadersAnnotation, headers)
+		}
+		c.Headers = headers
+	}
+
+	c.Credentials, err = boolAnnotation(i, corsAllowCredentialsAnnotation, false)
+	if err != nil {
+		return nil, err
+	}
+	if c.Credentials && c.AnyOrigin {
+		return nil, fmt.Errorf("%s can't be used with any origin", corsAllowCredentialsAnnotation)
+	}
+
+	if maxAge, ok := i.Annotations[corsMaxAgeAnnotation]; ok {
+		c.MaxAge, err = strconv.Atoi(maxAge)
+		if err != nil || c.MaxAge < 0 {
+			return nil, fmt.Errorf("%s must be a number of seconds, got %q", corsMaxAgeAnnotation, maxAge)
+		}
+	}
+
+	return c, nil
+}
+
+// preflightResponse returns the raw HTTP response to a preflight request from
+// the origin.
+func (c *cors) preflightResponse(origin string) string {
+	headers := []string{
+		"HTTP/1.1 204 No Content",
+		"Access-Control-Allow-Origin: " + origin,
+		"Access-Control-Allow-Methods: " + c.Methods,
+		"Access-Control-Allow-Headers: " + c.Headers,
+		"Access-Control-Max-Age: " + strconv.Itoa(c.MaxAge),
+	}
+	if c.Credentials {
+		headers = append(headers, "Access-Control-Allow-Credentials: true")
+	}
+	if !c.AnyOrigin {
+		headers = append(headers, "Vary: Origin")
+	}
+	headers = append(headers, "Content-Length: 0", "Connection: close")
+
+	return strings.Join(headers, "\r\n") + "\r\n\r\n"
+}
+
+// tunnelTimeoutFrom returns the tunnel timeout in seconds in the ingress's
+// annotations, or 0 if it doesn't set one.
+func tunnelTimeoutFrom(i extensions.Ingress) (int, error) {
+	timeout, ok := i.Annotations[tunnelTimeoutAnnotation]
+	if !ok {
+		return 0, nil
+	}
+
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds, got %q", tunnelTimeoutAnnotation, timeout)
+	}
+	return seconds, nil
+}
+
+type healthCheck struct {
+	// Path, if set, has servers checked with an HTTP request, expecting
+	// Status if it's set.
+	Method, Path string
+	Status       int
+	// Interval is in seconds. Interval, Rise and Fall are HAProxy's
+	// defaults when 0.
+	Interval, Rise, Fall int
+}
+
+// healthCheckFrom returns the health check settings in the ingress's
+// annotations, or nil if it turns health checks off.
+func healthCheckFrom(i extensions.Ingress) (*healthCheck, error) {
+	enabled, err := boolAnnotation(i, healthCheckAnnotation, true)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	hc := &healthCheck{}
+	if path, ok := i.Annotations[healthCheckPathAnnotation]; ok {
+		if !validCheckPath.MatchString(path) {
+			return nil, fmt.Errorf("invalid %s: %q", healthCheckPathAnnotation, path)
+		}
+		hc.Method = "GET"
+		hc.Path = path
+	}
+
+	if method, ok := i.Annotations[healthCheckMethodAnnotation]; ok {
+		if !validMethod.MatchString(method) {
+			return nil, fmt.Errorf("invalid %s: %q", healthCheckMethodAnnotation, method)
+		}
+		hc.Method = method
+	}
+
+	for _, setting := range []struct {
+		annotation string
+		value      *int
+		min, max   int
+	}{
+		{healthCheckStatusAnnotation, &hc.Status, 100, 599},
+		{healthCheckIntervalAnnotation, &hc.Interval, 1, 3600},
+		{healthCheckRiseAnnotation, &hc.Rise, 1, 100},
+		{healthCheckFallAnnotation, &hc.Fall, 1, 100},
+	} {
+		v, ok := i.Annotations[setting.annotation]
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < setting.min || n > setting.max {
+			return nil, fmt.Errorf("%s must be a number from %d to %d, got %q", setting.annotation, setting.min, setting.max, v)
+		}
+		*setting.value = n
+	}
+
+	return hc, nil
+}
+
+// withDefaults returns the health check with its unset settings taken from d,
+// which may be nil.
+func (hc *healthCheck) withDefaults(d *healthCheck) *healthCheck {
+	if hc == nil || d == nil {
+		return hc
+	}
+
+	merged := *hc
+	if merged.Path == "" {
+		merged.Path = d.Path
+		if merged.Method == "" {
+			merged.Method = d.Method
+		}
+	}
+	if merged.Status == 0 {
+		merged.Status = d.Status
+	}
+	if merged.Interval == 0 {
+		merged.Interval = d.Interval
+	}
+	if merged.Rise == 0 {
+		merged.Rise = d.Rise
+	}
+	if merged.Fall == 0 {
+		merged.Fall = d.Fall
+	}
+	return &merged
+}
+
+// errorPath is the path that responses with custom errors are redirected to,
+// followed by the status.
+const errorPath = "/.hing/errors/"
+
+type errorService struct {
+	Service string
+	Port    intstr.IntOrString
+	// Codes are the statuses replaced, in order.
+	Codes []int
+}
+
+// errorServiceFrom returns the custom error settings in the ingress's
+// annotations, or nil if it doesn't have any.
+func errorServiceFrom(i extensions.Ingress) (*errorService, error) {
+	codes, ok := i.Annotations[customHTTPErrorsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	service := i.Annotations[errorServiceAnnotation]
+	colon := strings.LastIndex(service, ":")
+	if colon < 0 {
+		return nil, fmt.Errorf("%s must be <service>:<port>, got %q", errorServiceAnnotation, service)
+	}
+
+	es := &errorService{Service: service[:colon]}
+	if !validServiceName.MatchString(es.Service) {
+		return nil, fmt.Errorf("invalid %s: %q", errorServiceAnnotation, service)
+	}
+
+	port := service[colon+1:]
+	if n, err := strconv.Atoi(port); err == nil && n > 0 && n <= 65535 {
+		es.Port = intstr.FromInt(n)
+	} else if err != nil && validServiceName.MatchString(port) {
+		es.Port = intstr.FromString(port)
+	} else {
+		return nil, fmt.Errorf("invalid %s: %q", errorServiceAnnotation, service)
+	}
+
+	for _, c := range strings.Split(codes, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid status %q in %s", c, customHTTPErrorsAnnotation)
+		}
+		es.Codes = append(es.Codes, code)
+	}
+
+	return es, nil
+}
+
+// generated returns the statuses replaced that HAProxy answers with itself,
+// rather than the backend, which can't be.
+func (es *errorService) generated() []int {
+	if es == nil {
+		return nil
+	}
+
+	var codes []int
+	for _, code := range es.Codes {
+		if code == 502 || code == 504 {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// redirect returns the redirect to the error service for the backend's
+// responses.
+func (es *errorService) redirect() *errorRedirect {
+	if es == nil {
+		return nil
+	}
+
+	r := &errorRedirect{Path: errorPath}
+	var codes []string
+	for _, code := range es.Codes {
+		codes = append(codes, strconv.Itoa(code))
+		if code == 503 {
+			r.Unavailable = true
+		}
+	}
+	r.Codes = strings.Join(codes, " ")
+	return r
+}
+
+// headerRules returns the rules passing the original status and request to
+// the error service.
+func (es *errorService) headerRules(namespace, ingress string) []string {
+	return []string{
+		`http-request set-header X-Code %[path,field(4,/)]`,
+		`http-request set-header X-Request-ID %[urlp(request_id)]`,
+		fmt.Sprintf(`http-request set-header X-Namespace "%s"`, namespace),
+		fmt.Sprintf(`http-request set-header X-Ingress-Name "%s"`, ingress),
+	}
+}
@@ -0,0 +1,1228 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// annotatedIngress returns an ingress routing foo/ to the foo service with the
+// given annotations.
+func annotatedIngress(annotations map[string]string) extensions.Ingress {
+	return extensions.Ingress{
+		ObjectMeta: api.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: extensions.IngressSpec{
+			Rules: []extensions.IngressRule{
+				{
+					Host: "foo",
+					IngressRuleValue: extensions.IngressRuleValue{
+						HTTP: &extensions.HTTPIngressRuleValue{
+							Paths: []extensions.HTTPIngressPath{
+								{
+									Path: "/",
+									Backend: extensions.IngressBackend{
+										ServiceName: "foo",
+										ServicePort: intstr.FromInt(3000),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestCanaryFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *canary
+		err         bool
+	}{
+		{
+			name:        "no canary",
+			annotations: nil,
+		},
+		{
+			name: "weighted canary",
+			annotations: map[string]string{
+				canaryServiceAnnotation: "foo-canary",
+				canaryWeightAnnotation:  "10",
+			},
+			expected: &canary{Service: "foo-canary", Weight: 10},
+		},
+		{
+			name: "missing weight",
+			annotations: map[string]string{
+				canaryServiceAnnotation: "foo-canary",
+			},
+			err: true,
+		},
+		{
+			name: "weight over 100",
+			annotations: map[string]string{
+				canaryServiceAnnotation: "foo-canary",
+				canaryWeightAnnotation:  "101",
+			},
+			err: true,
+		},
+		{
+			name: "header and cookie canary",
+			annotations: map[string]string{
+				canaryServiceAnnotation:       "foo-canary",
+				canaryByHeaderAnnotation:      "X-Canary",
+				canaryByHeaderValueAnnotation: "always",
+				canaryByCookieAnnotation:      "canary",
+			},
+			expected: &canary{Service: "foo-canary", Header: "X-Canary", HeaderValue: "always", Cookie: "canary"},
+		},
+		{
+			name: "header without value",
+			annotations: map[string]string{
+				canaryServiceAnnotation:  "foo-canary",
+				canaryByHeaderAnnotation: "X-Canary",
+			},
+			err: true,
+		},
+		{
+			name: "header value with whitespace",
+			annotations: map[string]string{
+				canaryServiceAnnotation:       "foo-canary",
+				canaryByHeaderAnnotation:      "X-Canary",
+				canaryByHeaderValueAnnotation: "a b",
+			},
+			err: true,
+		},
+		{
+			name: "invalid service",
+			annotations: map[string]string{
+				canaryServiceAnnotation: "foo canary",
+				canaryWeightAnnotation:  "10",
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := canaryFrom(annotatedIngress(test.annotations))
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestFeaturesFromCanary(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			canaryServiceAnnotation: "foo-canary",
+			canaryWeightAnnotation:  "10",
+		}),
+	}
+
+	expected := []backend{
+		{
+			Name:        "default_foo_42d5046e",
+			HealthCheck: &healthCheck{},
+			Weighted:    true,
+			Servers: []server{
+				{
+					Name:    "foo",
+					Address: "foo.default.svc.cluster.local:3000",
+					Weight:  90,
+				},
+				{
+					Name:    "foo_canary",
+					Address: "foo-canary.default.svc.cluster.local:3000",
+					Weight:  10,
+				},
+			},
+		},
+	}
+
+	f, err := featuresFrom(ingresses, "example.com", "cluster.local", &fakeClient{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(f.Backends, expected) {
+		t.Logf("want: %#v", expected)
+		t.Logf(" got: %#v", f.Backends)
+		t.Fatal("unexpected backends")
+	}
+}
+
+func TestUpdateCanaryByHeader(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			canaryServiceAnnotation:       "foo-canary",
+			canaryByHeaderAnnotation:      "X-Canary",
+			canaryByHeaderValueAnnotation: "always",
+			canaryByCookieAnnotation:      "canary",
+		}),
+	}
+
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{})
+
+	expected := `
+	acl is_default_foo_42d5046e_path path_beg /
+	acl is_default_foo_42d5046e_canary req.hdr(X-Canary) -m str always
+	acl is_default_foo_42d5046e_canary req.cook(canary) -m found
+	use_backend default_foo_42d5046e_canary if is_default_foo_b920a8e2 is_default_foo_42d5046e_path is_default_foo_42d5046e_canary
+	use_backend default_foo_42d5046e if is_default_foo_b920a8e2 is_default_foo_42d5046e_path
+`
+	if !strings.Contains(contents, expected) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected canary rules ahead of use_backend")
+	}
+
+	if !strings.Contains(contents, "backend default_foo_42d5046e_canary") {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected canary backend")
+	}
+}
+
+func TestAffinityFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *affinity
+		err         bool
+	}{
+		{
+			name:        "no affinity",
+			annotations: nil,
+		},
+		{
+			name: "default cookie",
+			annotations: map[string]string{
+				affinityAnnotation: "cookie",
+			},
+			expected: &affinity{Cookie: "SERVERID"},
+		},
+		{
+			name: "configured cookie",
+			annotations: map[string]string{
+				affinityAnnotation:              "cookie",
+				sessionCookieNameAnnotation:     "route",
+				sessionCookieMaxAgeAnnotation:   "3600",
+				sessionCookieFallbackAnnotation: "persist",
+			},
+			expected: &affinity{Cookie: "route", MaxAge: 3600, Persist: true},
+		},
+		{
+			name: "unsupported affinity",
+			annotations: map[string]string{
+				affinityAnnotation: "ip",
+			},
+			err: true,
+		},
+		{
+			name: "invalid max age",
+			annotations: map[string]string{
+				affinityAnnotation:            "cookie",
+				sessionCookieMaxAgeAnnotation: "1h",
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := affinityFrom(annotatedIngress(test.annotations))
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestFeaturesFromAffinity(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			affinityAnnotation: "cookie",
+		}),
+	}
+
+	kube := &fakeClient{
+		services: map[string]*api.Service{
+			"default/foo": {
+				Spec: api.ServiceSpec{
+					Ports: []api.ServicePort{
+						{Name: "http", Port: 3000, TargetPort: intstr.FromInt(8080)},
+					},
+				},
+			},
+		},
+		endpoints: map[string]*api.Endpoints{
+			"default/foo": {
+				Subsets: []api.EndpointSubset{
+					{
+						Addresses: []api.EndpointAddress{
+							{IP: "10.0.0.2", TargetRef: &api.ObjectReference{Name: "foo-2"}},
+							{IP: "10.0.0.1", TargetRef: &api.ObjectReference{Name: "foo-1"}},
+						},
+						Ports: []api.EndpointPort{
+							{Name: "http", Port: 8080},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	expected := []backend{
+		{
+			Name:        "default_foo_42d5046e",
+			HealthCheck: &healthCheck{},
+			Affinity:    &affinity{Cookie: "SERVERID"},
+			Servers: []server{
+				{
+					Name:    "foo-1",
+					Address: "10.0.0.1:8080",
+					Cookie:  podCookie("default", "foo-1"),
+				},
+				{
+					Name:    "foo-2",
+					Address: "10.0.0.2:8080",
+					Cookie:  podCookie("default", "foo-2"),
+				},
+			},
+		},
+	}
+
+	f, err := featuresFrom(ingresses, "example.com", "cluster.local", kube)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(f.Backends, expected) {
+		t.Logf("want: %#v", expected)
+		t.Logf(" got: %#v", f.Backends)
+		t.Fatal("unexpected backends")
+	}
+}
+
+func TestUpdateAuth(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			authSecretAnnotation: "foo-users",
+			authRealmAnnotation:  "dashboard",
+		}),
+	}
+
+	kube := &fakeClient{
+		secrets: map[string]*api.Secret{
+			"default/foo-users": {
+				Data: map[string][]byte{
+					"auth": []byte("# admins\nalice:$6$salt$hash\n\nbob:$5$salt$hash\n"),
+				},
+			},
+		},
+	}
+
+	contents := renderConfig(t, ingresses, kube, Options{})
+
+	for _, expected := range []string{
+		"\nuserlist default_foo_dash_users_9c56c171\n\tuser alice password $6$salt$hash\n\tuser bob password $5$salt$hash\n",
+		"\n\thttp-request auth realm dashboard unless { http_auth(default_foo_dash_users_9c56c171) }\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected config to contain %q", expected)
+		}
+	}
+}
+
+func TestFetchAuthSecretErrors(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{authSecretAnnotation: "foo-users"}),
+	}
+
+	kube := &fakeClient{
+		secrets: map[string]*api.Secret{
+			"default/foo-users": {Data: map[string][]byte{"auth": []byte("alice:$6$salt$hash\n")}},
+		},
+	}
+
+	c := NewConfig(&fakeIngress{listResults: ingresses}, withServices(kube, ingresses), "hostname", "", "example.com", Options{})
+	if _, err := c.Fetch(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	previous := c.previous
+
+	// The ingress is kept when the secret can't be fetched.
+	kube.secretsErr = fmt.Errorf("connection refused")
+	changed, err := c.Fetch()
+	if _, ok := err.(LookupError); !ok {
+		t.Fatalf("expected lookup error, got %v", err)
+	}
+	if changed || c.previous != previous {
+		t.Fatal("expected the previous config to be kept")
+	}
+
+	// It's dropped once the secret is gone.
+	kube.secretsErr = nil
+	delete(kube.secrets, "default/foo-users")
+	changed, err = c.Fetch()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !changed || len(c.previous.Backends) != 0 {
+		t.Fatal("expected the ingress to be dropped")
+	}
+}
+
+func TestSecretUsers(t *testing.T) {
+	tests := []struct {
+		name string
+		auth string
+		err  bool
+	}{
+		{
+			name: "crypt hashes",
+			auth: "alice:$6$salt$hash\n",
+		},
+		{
+			name: "apache md5",
+			auth: "alice:$apr1$salt$hash\n",
+			err:  true,
+		},
+		{
+			name: "trailing directive",
+			auth: "alice:$6$salt$hash stats enable\n",
+			err:  true,
+		},
+		{
+			name: "no users",
+			auth: "# nobody\n",
+			err:  true,
+		},
+	}
+
+	for i, test := range tests {
+		kube := &fakeClient{
+			secrets: map[string]*api.Secret{
+				"default/users": {Data: map[string][]byte{"auth": []byte(test.auth)}},
+			},
+		}
+
+		_, err := secretUsers(kube, "default", "users")
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+		}
+	}
+}
+
+func TestUpdateSourceRanges(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	var denied []string
+	for i := 1; i <= maxInlineCIDRs+1; i++ {
+		denied = append(denied, fmt.Sprintf("10.0.%d.0/24", i))
+	}
+
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			allowSourceRangeAnnotation: "10.0.0.0/8, 192.168.1.1",
+			denySourceRangeAnnotation:  strings.Join(denied, ","),
+		}),
+	}
+
+	confPath := dir + "/file"
+	c := NewConfig(&fakeIngress{listResults: ingresses}, withServices(&fakeClient{}, ingresses), "hostname", confPath, "example.com", Options{})
+	if _, err := c.Update(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := fmt.Sprintf(`
+	acl default_foo_d9ff28a9_allowed src 10.0.0.0/8 192.168.1.1
+	http-request deny if !default_foo_d9ff28a9_allowed
+	acl default_foo_d9ff28a9_denied src -f %s/generated/default_foo_d9ff28a9_denied.lst
+	http-request deny if default_foo_d9ff28a9_denied
+`, dir)
+	if !strings.Contains(string(contents), expected) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected source rules in backend")
+	}
+
+	list, err := ioutil.ReadFile(dir + "/generated/default_foo_d9ff28a9_denied.lst")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(list) != strings.Join(denied, "\n")+"\n" {
+		t.Fatalf("unexpected denied list:\n%s", list)
+	}
+}
+
+func TestSourceRangesFrom(t *testing.T) {
+	_, _, err := sourceRangesFrom(annotatedIngress(map[string]string{
+		allowSourceRangeAnnotation: "10.0.0.0/8 if TRUE",
+	}))
+	if err == nil {
+		t.Fatal("expected error for invalid range")
+	}
+}
+
+func TestRateLimitFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *rateLimit
+		err         bool
+	}{
+		{
+			name:        "no limits",
+			annotations: nil,
+		},
+		{
+			name: "request rate by source",
+			annotations: map[string]string{
+				limitRequestRateAnnotation: "5",
+			},
+			expected: &rateLimit{Type: "ipv6", Key: "src", Requests: 50, Action: "deny", Status: 429},
+		},
+		{
+			name: "connections by header with tarpit",
+			annotations: map[string]string{
+				limitConnectionsAnnotation: "10",
+				limitByHeaderAnnotation:    "X-Api-Key",
+				limitActionAnnotation:      "tarpit",
+				limitStatusAnnotation:      "503",
+			},
+			expected: &rateLimit{Type: "string len 64", Key: "req.hdr(X-Api-Key)", Connections: 10, Action: "tarpit", Status: 503},
+		},
+		{
+			name: "unsupported status",
+			annotations: map[string]string{
+				limitRequestRateAnnotation: "5",
+				limitStatusAnnotation:      "418",
+			},
+			err: true,
+		},
+		{
+			name: "negative rate",
+			annotations: map[string]string{
+				limitRequestRateAnnotation: "-1",
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := rateLimitFrom(annotatedIngress(test.annotations))
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestUpdateRateLimit(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			limitRequestRateAnnotation: "5",
+			limitConnectionsAnnotation: "10",
+		}),
+	}
+
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{})
+
+	expected := `
+	stick-table type ipv6 size 100k expire 30s store http_req_rate(10s),conn_cur
+	http-request track-sc0 src
+	http-request deny deny_status 429 if { sc0_http_req_rate gt 50 }
+	http-request deny deny_status 429 if { sc0_conn_cur gt 10 }
+`
+	if !strings.Contains(contents, expected) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected rate limits in backend")
+	}
+}
+
+func TestUpdateHTTPS(t *testing.T) {
+	ing := annotatedIngress(nil)
+	ing.Spec.TLS = []extensions.IngressTLS{{Hosts: []string{"foo"}}}
+
+	contents := renderConfig(t, []extensions.Ingress{ing}, &fakeClient{}, Options{})
+
+	for _, expected := range []string{
+		"\thttp-request redirect scheme https code 301 unless { ssl_fc } || { req.hdr(x-forwarded-proto) -i https }\n",
+		"\thttp-response set-header Strict-Transport-Security \"max-age=31536000\"\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+}
+
+func TestHTTPSFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		tlsHosts    []string
+		code        int
+		hsts        string
+		err         bool
+	}{
+		{
+			name: "plain http",
+		},
+		{
+			name:     "tls host",
+			tlsHosts: []string{"foo"},
+			code:     301,
+			hsts:     "max-age=31536000",
+		},
+		{
+			name: "tls host opted out",
+			annotations: map[string]string{
+				sslRedirectAnnotation: "false",
+				hstsAnnotation:        "false",
+			},
+			tlsHosts: []string{"foo"},
+		},
+		{
+			name: "configured",
+			annotations: map[string]string{
+				sslRedirectAnnotation:           "true",
+				sslRedirectCodeAnnotation:       "308",
+				hstsAnnotation:                  "true",
+				hstsMaxAgeAnnotation:            "600",
+				hstsIncludeSubdomainsAnnotation: "true",
+				hstsPreloadAnnotation:           "true",
+			},
+			code: 308,
+			hsts: "max-age=600; includeSubDomains; preload",
+		},
+		{
+			name: "unsupported code",
+			annotations: map[string]string{
+				sslRedirectAnnotation:     "true",
+				sslRedirectCodeAnnotation: "200",
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range tests {
+		ing := annotatedIngress(test.annotations)
+		if test.tlsHosts != nil {
+			ing.Spec.TLS = []extensions.IngressTLS{{Hosts: test.tlsHosts}}
+		}
+
+		code, hsts, err := httpsFrom(ing, "foo")
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if code != test.code || hsts != test.hsts {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %d %q", test.code, test.hsts)
+			t.Logf(" got: %d %q", code, hsts)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestRewriteFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		path     string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "strip prefix",
+			target:   "/",
+			path:     "/my/path",
+			expected: "^/my/path/?,/",
+		},
+		{
+			name:     "replace prefix with trailing slash",
+			target:   "/app",
+			path:     "/my/path/",
+			expected: "^/my/path/?,/app/",
+		},
+		{
+			name:     "root path",
+			target:   "/app/",
+			path:     "/",
+			expected: "^/?,/app/",
+		},
+		{
+			name:     "dotted path",
+			target:   "/",
+			path:     "/v1.0",
+			expected: "^/v1.0/?,/",
+		},
+		{
+			name:   "target with regsub syntax",
+			target: "/a,b)",
+			path:   "/",
+			err:    true,
+		},
+	}
+
+	for i, test := range tests {
+		ing := annotatedIngress(map[string]string{rewriteTargetAnnotation: test.target})
+		outcome, err := rewriteFrom(ing, test.path)
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if outcome != test.expected {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %s", test.expected)
+			t.Logf(" got: %s", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestHeaderRulesFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+		err         bool
+	}{
+		{
+			name: "request and response headers",
+			annotations: map[string]string{
+				setRequestHeadersAnnotation:     "X-Request-Start: t=%Ts%ms\nHost: upstream.example.com",
+				deleteResponseHeadersAnnotation: "Server",
+				addResponseHeadersAnnotation:    "X-Frame-Options: DENY",
+			},
+			expected: []string{
+				`http-request set-header X-Request-Start "t=%Ts%ms"`,
+				`http-request set-header Host "upstream.example.com"`,
+				`http-response del-header Server`,
+				`http-response add-header X-Frame-Options "DENY"`,
+			},
+		},
+		{
+			name: "path scoped headers",
+			annotations: map[string]string{
+				setRequestHeadersAnnotation: "/ X-Root: yes\n/other X-Other: yes",
+			},
+			expected: []string{
+				`http-request set-header X-Root "yes"`,
+			},
+		},
+		{
+			name: "quote in value",
+			annotations: map[string]string{
+				setRequestHeadersAnnotation: `X-Foo: a" if TRUE`,
+			},
+			err: true,
+		},
+		{
+			name: "sample fetch in value",
+			annotations: map[string]string{
+				setRequestHeadersAnnotation: "X-Foo: %[src]",
+			},
+			err: true,
+		},
+		{
+			name: "unknown variable in value",
+			annotations: map[string]string{
+				setRequestHeadersAnnotation: "X-Foo: %backend",
+			},
+			err: true,
+		},
+		{
+			name: "invalid header name",
+			annotations: map[string]string{
+				deleteRequestHeadersAnnotation: "X-Foo if TRUE",
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := headerRulesFrom(annotatedIngress(test.annotations), "/")
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestUpdateRewriteAndHeaders(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			rewriteTargetAnnotation:         "/app",
+			deleteResponseHeadersAnnotation: "Server",
+		}),
+	}
+
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{})
+
+	expected := `
+	option forwardfor
+	http-request set-path %[path,regsub(^/?,/app/)]
+	http-response del-header Server
+`
+	if !strings.Contains(contents, expected) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected rewrite and header rules in backend")
+	}
+}
+
+func TestUpdateRewriteDottedPath(t *testing.T) {
+	ingress := annotatedIngress(map[string]string{rewriteTargetAnnotation: "/"})
+	ingress.Spec.Rules[0].HTTP.Paths[0].Path = "/v1.0"
+
+	contents := renderConfig(t, []extensions.Ingress{ingress}, &fakeClient{}, Options{})
+
+	// A "]" in the regex would end the sample expression early.
+	expected := "\thttp-request set-path %[path,regsub(^/v1.0/?,/)]\n"
+	if !strings.Contains(contents, expected) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected rewrite of dotted path in backend")
+	}
+}
+
+func TestCORSFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *cors
+		err         bool
+	}{
+		{
+			name:        "disabled",
+			annotations: map[string]string{corsAllowOriginAnnotation: "https://example.com"},
+		},
+		{
+			name: "origins",
+			annotations: map[string]string{
+				enableCORSAnnotation:           "true",
+				corsAllowOriginAnnotation:      "https://example.com, http://localhost:8080",
+				corsAllowMethodsAnnotation:     "GET, POST",
+				corsAllowCredentialsAnnotation: "true",
+				corsMaxAgeAnnotation:           "600",
+			},
+			expected: &cors{
+				Origins:     []string{"https://example.com", "http://localhost:8080"},
+				Methods:     "GET, POST",
+				Headers:     "DNT, User-Agent, X-Requested-With, If-Modified-Since, Cache-Control, Content-Type, Range, Authorization",
+				Credentials: true,
+				MaxAge:      600,
+			},
+		},
+		{
+			name:        "invalid origin",
+			annotations: map[string]string{enableCORSAnnotation: "true", corsAllowOriginAnnotation: "https://example.com/ if TRUE"},
+			err:         true,
+		},
+		{
+			name:        "invalid headers",
+			annotations: map[string]string{enableCORSAnnotation: "true", corsAllowHeadersAnnotation: "X-Foo\r\nX-Bar"},
+			err:         true,
+		},
+		{
+			name:        "credentials with any origin",
+			annotations: map[string]string{enableCORSAnnotation: "true", corsAllowCredentialsAnnotation: "true"},
+			err:         true,
+		},
+		{
+			name:        "negative max age",
+			annotations: map[string]string{enableCORSAnnotation: "true", corsMaxAgeAnnotation: "-1"},
+			err:         true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := corsFrom(annotatedIngress(test.annotations))
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestUpdateCORS(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			enableCORSAnnotation:      "true",
+			corsAllowOriginAnnotation: "https://example.com",
+		}),
+	}
+
+	confPath := dir + "/file"
+	c := NewConfig(&fakeIngress{listResults: ingresses}, withServices(&fakeClient{}, ingresses), "hostname", confPath, "example.com", Options{})
+	if _, err := c.Update(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{
+		"METH_OPTIONS { req.hdr(access-control-request-method) -m found } { req.hdr(origin) -m str https://example.com }\n",
+		`http-response set-header Access-Control-Allow-Origin "https://example.com" if { var(txn.cors_origin) -m str https://example.com }`,
+		"http-response add-header Vary Origin\n",
+		"_preflight_0\n\t# Answered by HAProxy with the response in the errorfile.\n\thttp-request deny deny_status 200\n",
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir + "/" + generatedDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected a preflight response file, got %d files", len(files))
+	}
+
+	response, err := ioutil.ReadFile(dir + "/" + generatedDir + "/" + files[0].Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 204 No Content\r\nAccess-Control-Allow-Origin: https://example.com\r\n") ||
+		!strings.HasSuffix(string(response), "Content-Length: 0\r\nConnection: close\r\n\r\n") {
+		t.Fatalf("unexpected preflight response %q", response)
+	}
+}
+
+func TestUpdateTunnelTimeout(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{tunnelTimeoutAnnotation: "86400"}),
+	}
+
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{TunnelTimeout: 2 * time.Hour})
+
+	for _, expected := range []string{
+		"\ttimeout tunnel 7200s\n",
+		"\toption forwardfor\n\ttimeout tunnel 86400s\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+}
+
+func TestTunnelTimeoutFrom(t *testing.T) {
+	for _, timeout := range []string{"0", "-1", "1h", "10 if TRUE"} {
+		if _, err := tunnelTimeoutFrom(annotatedIngress(map[string]string{tunnelTimeoutAnnotation: timeout})); err == nil {
+			t.Errorf("expected error for %q", timeout)
+		}
+	}
+}
+
+func TestHealthCheckFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *healthCheck
+		err         bool
+	}{
+		{
+			name:     "default",
+			expected: &healthCheck{},
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{healthCheckAnnotation: "false"},
+		},
+		{
+			name: "http",
+			annotations: map[string]string{
+				healthCheckPathAnnotation:     "/healthz?full=1",
+				healthCheckMethodAnnotation:   "HEAD",
+				healthCheckStatusAnnotation:   "204",
+				healthCheckIntervalAnnotation: "5",
+				healthCheckRiseAnnotation:     "1",
+				healthCheckFallAnnotation:     "3",
+			},
+			expected: &healthCheck{Method: "HEAD", Path: "/healthz?full=1", Status: 204, Interval: 5, Rise: 1, Fall: 3},
+		},
+		{
+			name:        "invalid path",
+			annotations: map[string]string{healthCheckPathAnnotation: "/ HTTP/1.1\r\nHost: foo"},
+			err:         true,
+		},
+		{
+			name:        "invalid method",
+			annotations: map[string]string{healthCheckMethodAnnotation: "get"},
+			err:         true,
+		},
+		{
+			name:        "invalid status",
+			annotations: map[string]string{healthCheckStatusAnnotation: "2xx"},
+			err:         true,
+		},
+		{
+			name:        "zero interval",
+			annotations: map[string]string{healthCheckIntervalAnnotation: "0"},
+			err:         true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := healthCheckFrom(annotatedIngress(test.annotations))
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestUpdateHealthCheckFromReadinessProbe(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{healthCheckFallAnnotation: "2"}),
+	}
+
+	kube := &fakeClient{
+		services: map[string]*api.Service{
+			"default/foo": {
+				Spec: api.ServiceSpec{
+					Selector: map[string]string{"app": "foo"},
+					Ports: []api.ServicePort{
+						{Name: "http", Port: 3000, TargetPort: intstr.FromString("web")},
+					},
+				},
+			},
+		},
+		pods: map[string]*api.Pod{
+			"default/foo-1": {
+				ObjectMeta: api.ObjectMeta{Labels: map[string]string{"app": "foo"}},
+				Spec: api.PodSpec{
+					Containers: []api.Container{
+						{
+							Name:  "sidecar",
+							Ports: []api.ContainerPort{{Name: "metrics", ContainerPort: 9090}},
+							ReadinessProbe: &api.Probe{
+								Handler: api.Handler{HTTPGet: &api.HTTPGetAction{Path: "/metrics", Port: intstr.FromString("metrics")}},
+							},
+						},
+						{
+							Name:  "web",
+							Ports: []api.ContainerPort{{Name: "web", ContainerPort: 8080}},
+							ReadinessProbe: &api.Probe{
+								Handler:          api.Handler{HTTPGet: &api.HTTPGetAction{Path: "/ready", Port: intstr.FromString("web")}},
+								PeriodSeconds:    10,
+								SuccessThreshold: 1,
+								FailureThreshold: 3,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	contents := renderConfig(t, ingresses, kube, Options{})
+
+	for _, expected := range []string{
+		"\toption forwardfor\n\toption httpchk GET /ready\n",
+		"\tserver foo foo.default.svc.cluster.local:3000 resolvers dns check inter 10s rise 1 fall 2\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+
+	// Services and pods are looked up in lists rather than fetched one by
+	// one.
+	if kube.gets != 0 {
+		t.Errorf("expected no gets, got %d", kube.gets)
+	}
+}
+
+func TestUpdateHealthCheckDisabled(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{healthCheckAnnotation: "false"}),
+	}
+
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{})
+
+	if !strings.Contains(contents, "\tserver foo foo.default.svc.cluster.local:3000 resolvers dns\n") {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected server without health checks")
+	}
+}
+
+func TestErrorServiceFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    *errorService
+		err         bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "named port",
+			annotations: map[string]string{
+				customHTTPErrorsAnnotation: "404, 502,503",
+				errorServiceAnnotation:     "errors:http",
+			},
+			expected: &errorService{Service: "errors", Port: intstr.FromString("http"), Codes: []int{404, 502, 503}},
+		},
+		{
+			name: "missing service",
+			annotations: map[string]string{
+				customHTTPErrorsAnnotation: "502",
+			},
+			err: true,
+		},
+		{
+			name: "invalid service",
+			annotations: map[string]string{
+				customHTTPErrorsAnnotation: "502",
+				errorServiceAnnotation:     "errors.other:80",
+			},
+			err: true,
+		},
+		{
+			name: "invalid status",
+			annotations: map[string]string{
+				customHTTPErrorsAnnotation: "302",
+				errorServiceAnnotation:     "errors:80",
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range tests {
+		outcome, err := errorServiceFrom(annotatedIngress(test.annotations))
+		if (err != nil) != test.err {
+			t.Errorf("%d: %s: unexpected error: %v", i+1, test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("%d: %s", i+1, test.name)
+			t.Logf("want: %#v", test.expected)
+			t.Logf(" got: %#v", outcome)
+			t.Error("outcome did not match expected")
+		}
+	}
+}
+
+func TestErrorServiceGenerated(t *testing.T) {
+	es := &errorService{Service: "errors", Port: intstr.FromInt(80), Codes: []int{404, 502, 503, 504}}
+	if outcome, expected := es.generated(), []int{502, 504}; !reflect.DeepEqual(outcome, expected) {
+		t.Logf("want: %v", expected)
+		t.Logf(" got: %v", outcome)
+		t.Error("outcome did not match expected")
+	}
+}
+
+func TestUpdateErrorService(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{
+			customHTTPErrorsAnnotation: "404,502,503",
+			errorServiceAnnotation:     "errors:8080",
+			authSecretAnnotation:       "foo-users",
+			allowSourceRangeAnnotation: "10.0.0.0/8",
+		}),
+	}
+
+	kube := &fakeClient{
+		secrets: map[string]*api.Secret{
+			"default/foo-users": {Data: map[string][]byte{"auth": []byte("alice:$6$salt$hash\n")}},
+		},
+	}
+
+	contents := renderConfig(t, ingresses, kube, Options{})
+
+	for _, expected := range []string{
+		"\tuse_backend default_foo_d9ff28a9_error_service if is_default_foo_b920a8e2 { path_beg /.hing/errors/ }\n\tacl is_default_foo_42d5046e_path path_beg /\n",
+		"\thttp-request set-var(txn.error_redirect) bool(true) if METH_GET { req.hdr(accept) -m sub -i text/html }\n" +
+			"\thttp-response redirect location /.hing/errors/%[status]?request_id=%ID code 302 if { status 404 502 503 } { var(txn.error_redirect) -m bool }\n" +
+			"\thttp-request redirect location /.hing/errors/503?request_id=%ID code 302 if { nbsrv eq 0 } { var(txn.error_redirect) -m bool }\n",
+		"backend default_foo_d9ff28a9_error_service\n" +
+			"\t# Close connections after the proxy.\n" +
+			"\toption http-server-close\n" +
+			"\t# Include X-Forward-For header.\n" +
+			"\toption forwardfor\n" +
+			"\tacl default_foo_d9ff28a9_allowed src 10.0.0.0/8\n" +
+			"\thttp-request deny if !default_foo_d9ff28a9_allowed\n" +
+			"\thttp-request auth unless { http_auth(default_foo_dash_users_9c56c171) }\n",
+		"\thttp-request set-header X-Code %[path,field(4,/)]\n\thttp-request set-header X-Request-ID %[urlp(request_id)]\n",
+		"\tserver errors errors.default.svc.cluster.local:8080 resolvers dns check\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
 	"k8s.io/kubernetes/pkg/apis/extensions"
 	"k8s.io/kubernetes/pkg/client/unversioned"
 )
@@ -19,6 +23,11 @@ var (
 
 	// Shamelessly borrowed from http://stackoverflow.com/questions/106179/regular-expression-to-match-dns-hostname-or-ip-address
 	validHost = regexp.MustCompile(`^(([a-zA-Z]|[a-zA-Z][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z]|[A-Za-z][A-Za-z0-9\-]*[A-Za-z0-9])$`)
+
+	// Service names are DNS labels, and most other object names are DNS
+	// subdomains.
+	validServiceName = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	validSubdomain   = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
 )
 
 type ListError struct {
@@ -29,32 +38,226 @@ func (l ListError) Error() string {
 	return l.e.Error()
 }
 
+// LookupError is returned by Fetch when an object the ingresses refer to
+// can't be fetched, rather than being missing. The previous config is kept
+// instead of dropping the ingresses that need the object.
+type LookupError struct {
+	e error
+}
+
+func (l LookupError) Error() string {
+	return l.e.Error()
+}
+
 type Config struct {
 	hostname, path, baseDomain string
 	client                     unversioned.IngressInterface
+	kube                       Client
+	opts                       Options
 
-	previous *extensions.IngressList
+	previous *features
 }
 
-func NewConfig(client unversioned.IngressInterface, hostname, path, baseDomain string) *Config {
+// Client looks up the objects that ingresses refer to.
+type Client interface {
+	unversioned.ServicesNamespacer
+	unversioned.EndpointsNamespacer
+	unversioned.SecretsNamespacer
+	unversioned.ConfigMapsNamespacer
+	unversioned.PodsNamespacer
+}
+
+// Options are settings for the rendered config that don't come from the
+// cluster.
+type Options struct {
+	// MasterWorker renders the admin socket used to pass listeners between
+	// workers when HAProxy runs in master-worker mode.
+	MasterWorker bool
+	// TunnelTimeout is how long upgraded connections, such as WebSockets,
+	// may be idle unless their ingress sets its own. It defaults to an hour.
+	TunnelTimeout time.Duration
+	// TCPServices is the namespace/name of the ConfigMap of TCP services, if
+	// any.
+	TCPServices string
+	// StatusPort is the port hing serves health checks and metrics on, which
+	// TCP services can't use.
+	StatusPort int
+	// ErrorPages is the namespace/name of the ConfigMap of pages for 404,
+	// 502, 503 and 504 responses, keyed by status, if any.
+	ErrorPages string
+	// ClusterDomain is the domain that services are named in, cluster.local
+	// by default.
+	ClusterDomain string
+	// Nameservers are the IP addresses of the DNS servers HAProxy resolves
+	// service names with after starting.
+	Nameservers []string
+	// ResolverHold is how long a resolved address is used before it's looked
+	// up again, 10s by default. ResolverTimeout is how long HAProxy waits
+	// for an answer before asking again, 1s by default.
+	ResolverHold    time.Duration
+	ResolverTimeout time.Duration
+}
+
+const (
+	defaultTunnelTimeout   = time.Hour
+	defaultClusterDomain   = "cluster.local"
+	defaultResolverHold    = 10 * time.Second
+	defaultResolverTimeout = time.Second
+)
+
+func NewConfig(client unversioned.IngressInterface, kube Client, hostname, path, baseDomain string, opts Options) *Config {
 	return &Config{
 		hostname:   hostname,
 		path:       path,
 		baseDomain: baseDomain,
 		client:     client,
-		previous:   &extensions.IngressList{},
+		kube:       kube,
+		opts:       opts,
 	}
 }
 
+// features is everything from the cluster that is rendered into the config.
+type features struct {
+	Backends  []backend
+	HostACLs  []acl
+	Frontends []frontend
+	Userlists []userlist
+	// TCPServices are from the ConfigMap named in the options.
+	TCPServices []tcpService
+	// ErrorPages are from the ConfigMap named in the options, except for
+	// the 404 page in NotFoundPage.
+	ErrorPages   []errorPage
+	NotFoundPage string
+	// NotFounds serve the 404 pages of ingresses that have their own.
+	NotFounds []notFound
+	// ErrorRoutes route redirected error responses to error services.
+	ErrorRoutes []errorRoute
+	// Files are written to the generated directory, keyed by name.
+	Files map[string]string
+
+	// names are the names of backends, ACLs and userlists, with what they
+	// belong to.
+	names map[string]string
+}
+
+// addUserlist adds the userlist unless one with the same name, and so from
+// the same secret, has already been added.
+func (f *features) addUserlist(ul userlist) {
+	for _, existing := range f.Userlists {
+		if existing.Name == ul.Name {
+			return
+		}
+	}
+	f.Userlists = append(f.Userlists, ul)
+}
+
 type backend struct {
-	Name   string
-	Server string
+	Name    string
+	Servers []server
+	// Weighted balances requests across the servers by their weights
+	// rather than by least connections.
+	Weighted bool
+	// Affinity, if set, pins clients to a server with a cookie.
+	Affinity *affinity
+	// Auth, if set, requires requests to authenticate as a user in its
+	// userlist.
+	Auth *auth
+	// SourceRules deny requests by their source address.
+	SourceRules []sourceRule
+	// RateLimit, if set, limits the requests and connections of each client.
+	RateLimit *rateLimit
+	// SSLRedirect, if set, is the status code to redirect plain HTTP
+	// requests to HTTPS with.
+	SSLRedirect int
+	// HSTS, if set, is the Strict-Transport-Security header for responses.
+	HSTS string
+	// Rewrite, if set, holds the regsub arguments that rewrite the path
+	// before it's forwarded.
+	Rewrite string
+	// HeaderRules change request and response headers.
+	HeaderRules []string
+	// CORS, if set, adds the Access-Control headers to responses.
+	CORS *cors
+	// TunnelTimeout, if set, overrides the global tunnel timeout in seconds.
+	TunnelTimeout int
+	// HealthCheck, if set, has the servers checked.
+	HealthCheck *healthCheck
+	// ErrorPages replace HAProxy's responses for errors in the backend.
+	ErrorPages []errorPage
+	// ErrorRedirect, if set, redirects error responses to an error service.
+	ErrorRedirect *errorRedirect
+	// Host, if set, replaces the Host header of requests, for services that
+	// stand for an external host.
+	Host string
+	// MissingService, if set, is the service the backend routes to, which
+	// doesn't exist, so the backend has no servers and answers with a 503.
+	MissingService string
+}
+
+// errorRedirect redirects responses with any of the Codes, which are space
+// separated, to Path followed by the status. HAProxy's own error responses
+// can't be redirected with the request id, except for the 503 it answers
+// with when the backend has no servers, which Unavailable redirects before
+// the request is queued.
+type errorRedirect struct {
+	Path, Codes string
+	Unavailable bool
+}
+
+// errorRoute routes requests to the host's errorRedirect path to the error
+// service's Backend, which has the ingress's auth and source rules.
+type errorRoute struct {
+	HostACL, Backend, Path string
+}
+
+type sourceRule struct {
+	Name string
+	// CIDRs holds the space separated ranges, unless there are too many to
+	// fit comfortably on one line, in which case they're in File.
+	CIDRs, File string
+	// Allow denies requests from outside the ranges rather than inside them.
+	Allow bool
+}
+
+type userlist struct {
+	Name  string
+	Users []user
+}
+
+type user struct {
+	Name, Password string
+}
+
+type server struct {
+	Name, Address string
+	Weight        int
+	// Cookie identifies the server in the affinity cookie.
+	Cookie string
+	// SNI, if set, has the server reached over TLS, verified for that name.
+	SNI string
 }
 
 type frontend struct {
 	HostACL acl
 	PathACL acl
 	Backend backend
+	// Canary, if set, takes the requests matching any of its matchers ahead
+	// of Backend.
+	Canary *canaryFrontend
+	// Preflights answer CORS preflight requests ahead of Backend.
+	Preflights []preflight
+}
+
+// preflight is a backend without servers, answering the preflight requests
+// that match it with the response in File.
+type preflight struct {
+	Backend, Matcher, File string
+}
+
+type canaryFrontend struct {
+	ACLName  string
+	Matchers []string
+	Backend  backend
 }
 
 type acl struct {
@@ -63,86 +266,612 @@ type acl struct {
 
 // Update fetches the current ingress list from the given client, renders the
 // new template, and updates the file at the given filepath.
-func (c Config) Update() (bool, error) {
+func (c *Config) Update() (bool, error) {
+	changed, err := c.Fetch()
+	if err != nil || !changed {
+		return false, err
+	}
+
+	return true, c.Render()
+}
+
+// Fetch fetches the current ingress list from the given client, along with
+// the objects it refers to, and reports whether the resulting config has
+// changed since the last fetch. The result is kept for the next Render, so
+// several changes can be fetched before rendering once.
+func (c *Config) Fetch() (bool, error) {
 	l, err := c.client.List(api.ListOptions{})
 	if err != nil {
 		return false, ListError{err}
 	}
 
-	if reflect.DeepEqual(l.Items, c.previous.Items) {
+	// Services, endpoints and pods are listed once rather than fetched for
+	// every path.
+	kube, err := listClient(c.kube)
+	if err != nil {
+		return false, LookupError{err}
+	}
+
+	f, err := featuresFrom(l.Items, c.baseDomain, c.clusterDomain(), kube)
+	if err != nil {
+		return false, err
+	}
+	f.TCPServices = c.tcpServices(kube)
+	f.ErrorPages, f.NotFoundPage = withoutNotFound(c.errorPages(kube, f.Files))
+
+	if c.previous != nil && reflect.DeepEqual(f, c.previous) {
 		return false, nil
 	}
 
-	backends, hostACLs, frontends := featuresFrom(l.Items, c.baseDomain)
+	c.previous = f
+	return true, nil
+}
+
+// tcpServices returns the TCP services in the configured ConfigMap. If it
+// can't be fetched the previous ones are kept, so that their connections
+// aren't cut by a failed lookup.
+func (c *Config) tcpServices(kube Client) []tcpService {
+	if c.opts.TCPServices == "" {
+		return nil
+	}
+
+	var services []tcpService
+	if c.previous != nil {
+		services = c.previous.TCPServices
+	}
+
+	parts := strings.SplitN(c.opts.TCPServices, "/", 2)
+	if len(parts) != 2 {
+		log.Printf("invalid tcp services configmap %q, must be namespace/name", c.opts.TCPServices)
+		return services
+	}
+
+	cm, err := kube.ConfigMaps(parts[0]).Get(parts[1])
+	if err != nil {
+		log.Printf("failed to get tcp services: %v", err)
+		return services
+	}
+
+	tcp, err := tcpServicesFrom(kube, c.clusterDomain(), c.opts.StatusPort, cm.Data)
+	if err != nil {
+		log.Printf("failed to get tcp services: %v", err)
+		return services
+	}
+	return tcp
+}
+
+func (c *Config) clusterDomain() string {
+	if c.opts.ClusterDomain == "" {
+		return defaultClusterDomain
+	}
+	return c.opts.ClusterDomain
+}
+
+// errorPages returns the pages in the configured ConfigMap, adding them to
+// files. If it can't be fetched the previous pages are kept, so that a failed
+// lookup doesn't swap them for HAProxy's own.
+func (c *Config) errorPages(kube Client, files map[string]string) []errorPage {
+	if c.opts.ErrorPages == "" {
+		return nil
+	}
+
+	parts := strings.SplitN(c.opts.ErrorPages, "/", 2)
+	if len(parts) != 2 {
+		log.Printf("invalid error pages configmap %q, must be namespace/name", c.opts.ErrorPages)
+		return c.previousErrorPages(files)
+	}
+
+	cm, err := kube.ConfigMaps(parts[0]).Get(parts[1])
+	if err != nil {
+		log.Printf("failed to get error pages: %v", err)
+		return c.previousErrorPages(files)
+	}
+
+	return errorPagesFrom(c.opts.ErrorPages, "errors", cm.Data, files)
+}
+
+// previousErrorPages returns the pages of the previous config, adding their
+// files to files.
+func (c *Config) previousErrorPages(files map[string]string) []errorPage {
+	if c.previous == nil {
+		return nil
+	}
+
+	pages := append([]errorPage(nil), c.previous.ErrorPages...)
+	if c.previous.NotFoundPage != "" {
+		pages = append(pages, errorPage{Status: 404, File: c.previous.NotFoundPage})
+	}
+	for _, p := range pages {
+		files[p.File] = c.previous.Files[p.File]
+	}
+
+	sort.Sort(byStatus(pages))
+	return pages
+}
+
+// Render renders the template for the last fetched ingresses and updates the
+// file at the given filepath.
+func (c *Config) Render() error {
+	dir := filepath.Join(filepath.Dir(c.path), generatedDir)
+	if err := writeFiles(dir, c.previous.Files); err != nil {
+		return err
+	}
 
 	data := struct {
-		Backends  []backend
-		Frontends []frontend
-		HostACLs  []acl
-		Hostname  string
+		Backends     []backend
+		Frontends    []frontend
+		HostACLs     []acl
+		Userlists    []userlist
+		TCPServices  []tcpService
+		ErrorPages   []errorPage
+		NotFoundPage string
+		NotFounds    []notFound
+		ErrorRoutes  []errorRoute
+		Hostname     string
+		MasterWorker bool
+		Dir          string
+		// TunnelTimeout and ResolverHold are in seconds, and
+		// ResolverTimeout in milliseconds.
+		TunnelTimeout   int
+		Nameservers     []string
+		ResolverHold    int
+		ResolverTimeout int
 	}{
-		Backends:  backends,
-		Frontends: frontends,
-		HostACLs:  hostACLs,
-		Hostname:  c.hostname,
+		Backends:     c.previous.Backends,
+		Frontends:    c.previous.Frontends,
+		HostACLs:     c.previous.HostACLs,
+		Userlists:    c.previous.Userlists,
+		TCPServices:  c.previous.TCPServices,
+		ErrorPages:   c.previous.ErrorPages,
+		NotFoundPage: c.previous.NotFoundPage,
+		NotFounds:    c.previous.NotFounds,
+		ErrorRoutes:  c.previous.ErrorRoutes,
+		Hostname:     c.hostname,
+		MasterWorker: c.opts.MasterWorker,
+		Dir:          dir,
+		Nameservers:  c.opts.Nameservers,
 	}
 
-	w, err := os.Create(c.path)
-	if err != nil {
-		return false, err
+	data.TunnelTimeout = int(defaultTunnelTimeout / time.Second)
+	if c.opts.TunnelTimeout > 0 {
+		data.TunnelTimeout = int(c.opts.TunnelTimeout / time.Second)
+	}
+	data.ResolverHold = int(defaultResolverHold / time.Second)
+	if c.opts.ResolverHold >= time.Second {
+		data.ResolverHold = int(c.opts.ResolverHold / time.Second)
+	}
+	data.ResolverTimeout = int(defaultResolverTimeout / time.Millisecond)
+	if c.opts.ResolverTimeout >= time.Millisecond {
+		data.ResolverTimeout = int(c.opts.ResolverTimeout / time.Millisecond)
 	}
-	defer w.Close()
 
-	err = tmpl.Execute(w, data)
+	w, err := os.Create(c.path)
 	if err != nil {
-		return false, err
+		return err
 	}
+	defer w.Close()
 
-	c.previous = l
-	return true, nil
+	return tmpl.Execute(w, data)
 }
 
-func featuresFrom(ingresses []extensions.Ingress, baseDomain string) (backends []backend, hostACLs []acl, frontends []frontend) {
+func featuresFrom(ingresses []extensions.Ingress, baseDomain, clusterDomain string, kube Client) (*features, error) {
+	f := &features{Files: map[string]string{}}
 	for _, i := range ingresses {
+		if err := validateIngress(i); err != nil {
+			log.Printf("skipping ingress %q in %q: %v", i.Name, i.Namespace, err)
+			continue
+		}
+
+		canary, err := canaryFrom(i)
+		if err != nil {
+			log.Printf("ignoring canary for %s/%s: %v", i.Namespace, i.Name, err)
+		}
+
+		affinity, err := affinityFrom(i)
+		if err != nil {
+			log.Printf("ignoring affinity for %s/%s: %v", i.Namespace, i.Name, err)
+		}
+
+		// Routing without the authentication the ingress asks for would
+		// expose it, so it's skipped entirely instead.
+		var ba *auth
+		secret, realm, err := authFrom(i)
+		if err == nil && secret != "" {
+			var users []user
+			if users, err = secretUsers(kube, i.Namespace, secret); err == nil {
+				ul := userlist{Name: secretName(i.Namespace, secret), Users: users}
+				if _, err = f.claim(ul.Name, "secret "+i.Namespace+"/"+secret); err == nil {
+					f.addUserlist(ul)
+					ba = &auth{Userlist: ul.Name, Realm: realm}
+				}
+			}
+		}
+		if _, ok := err.(LookupError); ok {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("skipping ingress %s/%s: %v", i.Namespace, i.Name, err)
+			continue
+		}
+
+		allow, deny, err := sourceRangesFrom(i)
+		if err != nil {
+			log.Printf("skipping ingress %s/%s: %v", i.Namespace, i.Name, err)
+			continue
+		}
+		rateLimit, err := rateLimitFrom(i)
+		if err != nil {
+			log.Printf("skipping ingress %s/%s: %v", i.Namespace, i.Name, err)
+			continue
+		}
+
+		cors, err := corsFrom(i)
+		if err != nil {
+			log.Printf("ignoring cors for %s/%s: %v", i.Namespace, i.Name, err)
+		}
+
+		tunnelTimeout, err := tunnelTimeoutFrom(i)
+		if err != nil {
+			log.Printf("ignoring tunnel timeout for %s/%s: %v", i.Namespace, i.Name, err)
+		}
+
+		check, err := healthCheckFrom(i)
+		if err != nil {
+			log.Printf("ignoring health check settings for %s/%s: %v", i.Namespace, i.Name, err)
+			check = &healthCheck{}
+		}
+
+		errorService, err := errorServiceFrom(i)
+		if err != nil {
+			log.Printf("ignoring custom errors for %s/%s: %v", i.Namespace, i.Name, err)
+		} else if codes := errorService.generated(); len(codes) > 0 {
+			log.Printf("custom errors for %s/%s only replace the backend's %v responses, not HAProxy's own when it fails or times out", i.Namespace, i.Name, codes)
+		}
+
+		ingressName := ingressName(i.Namespace, i.Name)
+		if _, err := f.claim(ingressName, "ingress "+i.Namespace+"/"+i.Name); err != nil {
+			log.Printf("skipping ingress %s/%s: %v", i.Namespace, i.Name, err)
+			continue
+		}
+		errorPages, notFound := f.ingressErrorPages(kube, i, ingressName)
+
+		sourceRules := f.sourceRules(ingressName+"_allowed", allow, true)
+		sourceRules = append(sourceRules, f.sourceRules(ingressName+"_denied", deny, false)...)
+
+		var errorBackend string
+		if errorService != nil {
+			u, err := serviceUpstream(kube, clusterDomain, i.Namespace, extensions.IngressBackend{
+				ServiceName: errorService.Service,
+				ServicePort: errorService.Port,
+			})
+			if _, ok := err.(LookupError); ok {
+				return nil, err
+			}
+			if err != nil {
+				log.Printf("ignoring custom errors for %s/%s: %v", i.Namespace, i.Name, err)
+				errorService = nil
+			} else {
+				errorBackend = ingressName + "_error_service"
+				f.Backends = append(f.Backends, backend{
+					Name:        errorBackend,
+					Auth:        ba,
+					SourceRules: sourceRules,
+					HeaderRules: errorService.headerRules(i.Namespace, i.Name),
+					HealthCheck: &healthCheck{},
+					Host:        u.Host,
+					Servers:     []server{u.server(errorService.Service)},
+				})
+			}
+		}
+
 		for _, rule := range i.Spec.Rules {
 			valid := validHost.MatchString(rule.Host)
 			if !valid {
-				log.Printf("skipping invalid host: %s", rule.Host)
+				log.Printf("skipping invalid host: %q", rule.Host)
+				continue
+			}
+
+			if rule.HTTP == nil {
+				continue
+			}
+
+			sslRedirect, hsts, err := httpsFrom(i, rule.Host)
+			if err != nil {
+				log.Printf("skipping host %s in %s/%s: %v", rule.Host, i.Namespace, i.Name, err)
 				continue
 			}
 
 			hostACL := acl{
-				Name:    fmt.Sprintf("is_%s_%s", i.Namespace, rule.Host),
+				Name:    "is_" + hostName(i.Namespace, rule.Host),
 				Matcher: fmt.Sprintf("hdr_beg(host) -i %s", rule.Host+"."+baseDomain),
 			}
 
-			hostACLs = append(hostACLs, hostACL)
+			// Ingresses in the same namespace share their hosts' ACLs.
+			if _, err := f.claim(hostACL.Name, "host "+i.Namespace+"/"+rule.Host); err != nil {
+				log.Printf("skipping host %s in %s/%s: %v", rule.Host, i.Namespace, i.Name, err)
+				continue
+			}
+
+			f.HostACLs = append(f.HostACLs, hostACL)
+			if notFound != nil {
+				notFound.HostACLs = append(notFound.HostACLs, hostACL.Name)
+			}
+			if errorBackend != "" {
+				f.ErrorRoutes = append(f.ErrorRoutes, errorRoute{
+					HostACL: hostACL.Name,
+					Backend: errorBackend,
+					Path:    errorPath,
+				})
+			}
 
 			for _, path := range rule.HTTP.Paths {
-				name := canonicalizedName(i.Namespace, rule.Host, path.Path)
+				// An empty path matches everything, as "/" does.
+				if path.Path == "" {
+					path.Path = "/"
+				}
 
-				b := backend{
-					Name:   name,
-					Server: fmt.Sprintf("%s %s.%s.svc.cluster.local:%s", rule.Host, path.Backend.ServiceName, i.Namespace, path.Backend.ServicePort.String()),
+				if err := validatePath(path); err != nil {
+					log.Printf("skipping path %s%q in %s/%s: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+					continue
+				}
+
+				rewrite, err := rewriteFrom(i, path.Path)
+				if err != nil {
+					log.Printf("skipping path %s%s in %s/%s: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+					continue
+				}
+
+				headerRules, err := headerRulesFrom(i, path.Path)
+				if err != nil {
+					log.Printf("skipping path %s%s in %s/%s: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+					continue
+				}
+
+				name := routeName(i.Namespace, rule.Host, path.Path)
+				exists, err := f.claim(name, "path "+i.Namespace+"/"+rule.Host+path.Path)
+				if exists {
+					err = fmt.Errorf("already routed by another ingress")
+				}
+				if err != nil {
+					log.Printf("skipping path %s%s in %s/%s: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+					continue
 				}
-				backends = append(backends, b)
 
 				pathACL := acl{
 					Name:    fmt.Sprintf("is_%s_path", name),
 					Matcher: fmt.Sprintf("path_beg %s", path.Path),
 				}
 
-				frontends = append(frontends, frontend{
-					HostACL: hostACL,
-					PathACL: pathACL,
-					Backend: b,
-				})
+				u, err := serviceUpstream(kube, clusterDomain, i.Namespace, path.Backend)
+				if apierrors.IsNotFound(err) {
+					// The service's name wouldn't resolve, failing the
+					// reload for everyone, so the path is answered with a
+					// 503 until the service is created.
+					log.Printf("routing path %s%s in %s/%s to a 503: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+					b := backend{
+						Name:           name,
+						ErrorPages:     errorPages,
+						ErrorRedirect:  errorService.redirect(),
+						MissingService: path.Backend.ServiceName,
+					}
+					f.Backends = append(f.Backends, b)
+					f.Frontends = append(f.Frontends, frontend{HostACL: hostACL, PathACL: pathACL, Backend: b})
+					continue
+				}
+				if _, ok := err.(LookupError); ok {
+					return nil, err
+				}
+				if err != nil {
+					log.Printf("skipping path %s%s in %s/%s: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+					continue
+				}
+
+				// The canary is referred to with the same port, which may
+				// have a different number in its service.
+				pathCanary := canary
+				canaryBackend := path.Backend
+				var canaryUpstream upstream
+				if canary != nil {
+					canaryBackend.ServiceName = canary.Service
+					canaryUpstream, err = serviceUpstream(kube, clusterDomain, i.Namespace, canaryBackend)
+					// Weighted servers share their backend's Host header.
+					if err == nil && canary.Weight > 0 && canaryUpstream.Host != u.Host {
+						err = fmt.Errorf("weighted canary must have the same host as service %s", path.Backend.ServiceName)
+					}
+					if _, ok := err.(LookupError); ok {
+						return nil, err
+					}
+					if err != nil {
+						log.Printf("ignoring canary for %s%s in %s/%s: %v", rule.Host, path.Path, i.Namespace, i.Name, err)
+						pathCanary = nil
+					}
+				}
+
+				b := backend{
+					Name:          name,
+					Auth:          ba,
+					SourceRules:   sourceRules,
+					RateLimit:     rateLimit,
+					SSLRedirect:   sslRedirect,
+					HSTS:          hsts,
+					Rewrite:       rewrite,
+					HeaderRules:   headerRules,
+					CORS:          cors,
+					TunnelTimeout: tunnelTimeout,
+					HealthCheck:   backendCheck(kube, i.Namespace, path.Backend, check),
+					ErrorPages:    errorPages,
+					ErrorRedirect: errorService.redirect(),
+					Host:          u.Host,
+					Servers:       []server{u.server(rule.Host)},
+				}
+
+				if pathCanary != nil && pathCanary.Weight > 0 {
+					b.Weighted = true
+					b.Servers[0].Weight = 100 - pathCanary.Weight
+					s := canaryUpstream.server(rule.Host + "_canary")
+					s.Weight = pathCanary.Weight
+					b.Servers = append(b.Servers, s)
+				}
+
+				if affinity != nil {
+					// Cookies pin clients to pods, so each pod needs
+					// its own server rather than the service's.
+					servers, err := podServers(kube, i.Namespace, path.Backend)
+					if _, ok := err.(LookupError); ok {
+						return nil, err
+					}
+					switch {
+					case b.Weighted:
+						log.Printf("ignoring affinity for %s/%s: not supported with a weighted canary", i.Namespace, i.Name)
+					case err != nil:
+						log.Printf("ignoring affinity for %s/%s: %v", i.Namespace, i.Name, err)
+					default:
+						b.Affinity = affinity
+						b.Servers = servers
+					}
+				}
+				f.Backends = append(f.Backends, b)
+
+				fe := frontend{
+					HostACL:    hostACL,
+					PathACL:    pathACL,
+					Backend:    b,
+					Preflights: f.preflights(name, cors),
+				}
 
+				if matchers := pathCanary.matchers(); len(matchers) > 0 {
+					cb := backend{
+						Name:          name + "_canary",
+						Auth:          ba,
+						SourceRules:   sourceRules,
+						RateLimit:     rateLimit,
+						SSLRedirect:   sslRedirect,
+						HSTS:          hsts,
+						Rewrite:       rewrite,
+						HeaderRules:   headerRules,
+						CORS:          cors,
+						TunnelTimeout: tunnelTimeout,
+						HealthCheck:   backendCheck(kube, i.Namespace, canaryBackend, check),
+						ErrorPages:    errorPages,
+						ErrorRedirect: errorService.redirect(),
+						Host:          canaryUpstream.Host,
+						Servers:       []server{canaryUpstream.server(rule.Host + "_canary")},
+					}
+					f.Backends = append(f.Backends, cb)
+
+					fe.Canary = &canaryFrontend{
+						ACLName:  fmt.Sprintf("is_%s_canary", name),
+						Matchers: matchers,
+						Backend:  cb,
+					}
+				}
+
+				f.Frontends = append(f.Frontends, fe)
 			}
 		}
+
+		if notFound != nil && len(notFound.HostACLs) > 0 {
+			f.NotFounds = append(f.NotFounds, *notFound)
+		}
+	}
+
+	return f, nil
+}
+
+// ingressErrorPages returns the ingress's own error pages, if it has any,
+// adding them to the files. The 404 page is returned separately, in a backend
+// for the ingress's hosts to be added to.
+func (f *features) ingressErrorPages(kube Client, i extensions.Ingress, ingressName string) ([]errorPage, *notFound) {
+	name, ok := i.Annotations[errorPagesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	if !validSubdomain.MatchString(name) {
+		log.Printf("ignoring error pages for %s/%s: invalid %s: %q", i.Namespace, i.Name, errorPagesAnnotation, name)
+		return nil, nil
+	}
+
+	cm, err := kube.ConfigMaps(i.Namespace).Get(name)
+	if err != nil {
+		log.Printf("ignoring error pages for %s/%s: %v", i.Namespace, i.Name, err)
+		return nil, nil
+	}
+
+	pages, file := withoutNotFound(errorPagesFrom(i.Namespace+"/"+name, ingressName+"_errors", cm.Data, f.Files))
+	if file == "" {
+		return pages, nil
+	}
+	return pages, &notFound{Name: ingressName + "_not_found", File: file}
+}
+
+// backendCheck returns the ingress's health check for the backend, with
+// anything it doesn't set taken from the readiness probe of the service's pods
+// where there is one.
+func backendCheck(kube Client, namespace string, b extensions.IngressBackend, check *healthCheck) *healthCheck {
+	if check == nil {
+		return nil
+	}
+
+	// Services without pods, or pods without probes, just have their
+	// servers checked for connections.
+	probe, _ := readinessCheck(kube, namespace, b)
+	return check.withDefaults(probe)
+}
+
+// preflights returns the preflight backends for the named route, adding the
+// files for their responses. There's one for each allowed origin, since the
+// response is fixed.
+func (f *features) preflights(name string, c *cors) []preflight {
+	if c == nil {
+		return nil
+	}
+
+	origins := c.Origins
+	if c.AnyOrigin {
+		origins = []string{"*"}
+	}
+
+	var preflights []preflight
+	for n, origin := range origins {
+		p := preflight{
+			Backend: fmt.Sprintf("%s_preflight_%d", name, n),
+			Matcher: "{ req.hdr(origin) -m found }",
+		}
+		if !c.AnyOrigin {
+			p.Matcher = fmt.Sprintf("{ req.hdr(origin) -m str %s }", origin)
+		}
+		p.File = p.Backend + ".http"
+		f.Files[p.File] = c.preflightResponse(origin)
+
+		preflights = append(preflights, p)
+	}
+	return preflights
+}
+
+// maxInlineCIDRs is the most ranges rendered in an ACL before they're moved to
+// a file.
+const maxInlineCIDRs = 10
+
+// sourceRules returns the rule for the given ranges, if there are any, adding
+// a file for them when there are many.
+func (f *features) sourceRules(name string, cidrs []string, allow bool) []sourceRule {
+	if len(cidrs) == 0 {
+		return nil
 	}
 
-	return backends, hostACLs, frontends
+	r := sourceRule{Name: name, Allow: allow}
+	if len(cidrs) > maxInlineCIDRs {
+		r.File = name + ".lst"
+		f.Files[r.File] = strings.Join(cidrs, "\n") + "\n"
+	} else {
+		r.CIDRs = strings.Join(cidrs, " ")
+	}
+	return []sourceRule{r}
+}
+
+func serviceAddress(service, namespace, clusterDomain string, port int) string {
+	return fmt.Sprintf("%s.%s.svc.%s:%d", service, namespace, clusterDomain, port)
 }
 
 func canonicalizedName(namespace, host, path string) string {
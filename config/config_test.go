@@ -1,15 +1,21 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"reflect"
+	"strings"
 	"testing"
 
 	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	apiunversioned "k8s.io/kubernetes/pkg/api/unversioned"
 	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/client/unversioned/testclient"
+	"k8s.io/kubernetes/pkg/labels"
 	"k8s.io/kubernetes/pkg/util/intstr"
 )
 
@@ -21,6 +27,25 @@ func testDir(t *testing.T) (string, func()) {
 	return dir, func() { os.RemoveAll(dir) }
 }
 
+// renderConfig renders the ingresses with the client and options, returning
+// the config.
+func renderConfig(t *testing.T, ingresses []extensions.Ingress, kube *fakeClient, opts Options) string {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	confPath := dir + "/file"
+	c := NewConfig(&fakeIngress{listResults: ingresses}, withServices(kube, ingresses), "hostname", confPath, "example.com", opts)
+	if _, err := c.Update(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(contents)
+}
+
 func TestCanonicalizedName(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -143,6 +168,7 @@ func TestFeaturesFrom(t *testing.T) {
 			ingresses: []extensions.Ingress{
 				{
 					ObjectMeta: api.ObjectMeta{
+						Name:      "ingress-1",
 						Namespace: "default",
 					},
 					Spec: extensions.IngressSpec{
@@ -184,6 +210,7 @@ func TestFeaturesFrom(t *testing.T) {
 				},
 				{
 					ObjectMeta: api.ObjectMeta{
+						Name:      "ingress-2",
 						Namespace: "default",
 					},
 					Spec: extensions.IngressSpec{
@@ -210,51 +237,75 @@ func TestFeaturesFrom(t *testing.T) {
 			},
 			backends: []backend{
 				{
-					Name:   "default_foo",
-					Server: "foo foo.default.svc.cluster.local:3000",
+					Name:        "default_foo_42d5046e",
+					HealthCheck: &healthCheck{},
+					Servers: []server{
+						{
+							Name:    "foo",
+							Address: "foo.default.svc.cluster.local:3000",
+						},
+					},
 				},
 				{
-					Name:   "default_bar_my_path",
-					Server: "bar bar.default.svc.cluster.local:9000",
+					Name:        "default_bar_my_path_9dabd161",
+					HealthCheck: &healthCheck{},
+					Servers: []server{
+						{
+							Name:    "bar",
+							Address: "bar.default.svc.cluster.local:9000",
+						},
+					},
 				},
 			},
 			hostACLs: []acl{
 				{
-					Name:    "is_default_foo",
+					Name:    "is_default_foo_b920a8e2",
 					Matcher: "hdr_beg(host) -i foo.example.com",
 				},
 				{
-					Name:    "is_default_bar",
+					Name:    "is_default_bar_ebdb5bf3",
 					Matcher: "hdr_beg(host) -i bar.example.com",
 				},
 			},
 			frontends: []frontend{
 				{
 					HostACL: acl{
-						Name:    "is_default_foo",
+						Name:    "is_default_foo_b920a8e2",
 						Matcher: "hdr_beg(host) -i foo.example.com",
 					},
 					PathACL: acl{
-						Name:    "is_default_foo_path",
+						Name:    "is_default_foo_42d5046e_path",
 						Matcher: "path_beg /",
 					},
 					Backend: backend{
-						Name:   "default_foo",
-						Server: "foo foo.default.svc.cluster.local:3000",
+						Name:        "default_foo_42d5046e",
+						HealthCheck: &healthCheck{},
+						Servers: []server{
+							{
+								Name:    "foo",
+								Address: "foo.default.svc.cluster.local:3000",
+							},
+						},
 					},
 				},
 				{
 					HostACL: acl{
-						Name:    "is_default_bar",
+						Name:    "is_default_bar_ebdb5bf3",
 						Matcher: "hdr_beg(host) -i bar.example.com",
 					},
 					PathACL: acl{
-						Name:    "is_default_bar_my_path_path",
+						Name:    "is_default_bar_my_path_9dabd161_path",
 						Matcher: "path_beg /my/path",
 					},
 					Backend: backend{
-						Name:   "default_bar_my_path",
-						Server: "bar bar.default.svc.cluster.local:9000",
+						Name:        "default_bar_my_path_9dabd161",
+						HealthCheck: &healthCheck{},
+						Servers: []server{
+							{
+								Name:    "bar",
+								Address: "bar.default.svc.cluster.local:9000",
+							},
+						},
 					},
 				},
 			},
@@ -262,22 +313,25 @@ func TestFeaturesFrom(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		backends, hostACLs, frontends := featuresFrom(test.ingresses, "example.com")
-		if !reflect.DeepEqual(backends, test.backends) {
+		f, err := featuresFrom(test.ingresses, "example.com", "cluster.local", &fakeClient{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(f.Backends, test.backends) {
 			t.Logf("want: %#v", test.backends)
-			t.Logf(" got: %#v", backends)
+			t.Logf(" got: %#v", f.Backends)
 			t.Fatal("unexpected backends")
 		}
 
-		if !reflect.DeepEqual(frontends, test.frontends) {
+		if !reflect.DeepEqual(f.Frontends, test.frontends) {
 			t.Logf("want: %v", test.frontends)
-			t.Logf(" got: %v", frontends)
+			t.Logf(" got: %v", f.Frontends)
 			t.Fatal("unexpected frontends")
 		}
 
-		if !reflect.DeepEqual(hostACLs, test.hostACLs) {
+		if !reflect.DeepEqual(f.HostACLs, test.hostACLs) {
 			t.Logf("want: %v", test.hostACLs)
-			t.Logf(" got: %v", hostACLs)
+			t.Logf(" got: %v", f.HostACLs)
 			t.Fatal("unexpected hostACLs")
 		}
 	}
@@ -296,6 +350,7 @@ func TestUpdate(t *testing.T) {
 			ingresses: []extensions.Ingress{
 				{
 					ObjectMeta: api.ObjectMeta{
+						Name:      "ingress-3",
 						Namespace: "default",
 					},
 					Spec: extensions.IngressSpec{
@@ -321,6 +376,7 @@ func TestUpdate(t *testing.T) {
 				},
 				{
 					ObjectMeta: api.ObjectMeta{
+						Name:      "ingress-4",
 						Namespace: "default",
 					},
 					Spec: extensions.IngressSpec{
@@ -373,6 +429,11 @@ defaults
 	timeout queue 60s
 	timeout http-request 15s
 	timeout http-keep-alive 15s
+	# Upgraded connections, like WebSockets, are idle for longer than requests.
+	timeout tunnel 3600s
+	# Servers whose names don't resolve yet are started without an address,
+	# rather than failing the reload, and resolved at runtime.
+	default-server init-addr last,libc,none
 	option httplog
 	option redispatch
 	option dontlognull
@@ -385,6 +446,7 @@ listen stats
 
 resolvers dns
 	hold valid 10s
+	timeout retry 1000ms
 
 backend not_found
 	# This seems abusive.
@@ -397,51 +459,62 @@ frontend ingress
 	capture request header User-Agent len 128
 	capture request header Host len 64
 
+	# Requests are given an id, which servers and error services are passed.
+	unique-id-format %{+X}o\ %ci:%cp_%fi:%fp_%Ts_%rt:%pid
+	unique-id-header X-Request-ID
+
+	# Upgrade requests have the connection tunnelled once the server switches
+	# protocols. Clients may also ask for keep-alive, which would otherwise
+	# have the tunnel handled as an ordinary keep-alive connection.
+	acl is_upgrade hdr(connection) -m sub -i upgrade
+	acl is_upgrade_protocol req.hdr(upgrade) -m found
+	http-request set-header Connection upgrade if is_upgrade is_upgrade_protocol
+
 	# JSON logging for ES: http://www.rsyslog.com/json-elasticsearch/
-	log-format @cee:{"program":"haproxy","timestamp":%Ts,"http_status":%ST,"http_request":"%r","remote_addr":"%ci","bytes_read":%B,"upstream_addr":"%si","backend_name":"%b","retries":%rc,"bytes_uploaded":%U,"upstream_response_time":"%Tr","upstream_connect_time":"%Tc","session_duration":"%Tt","termination_state":"%ts","user_agent":"%[capture.req.hdr(1),json]","request_host":"%[capture.req.hdr(2),json]","host":"hostname"}
+	log-format @cee:{"program":"haproxy","timestamp":%Ts,"http_status":%ST,"http_request":"%r","remote_addr":"%ci","bytes_read":%B,"upstream_addr":"%si","backend_name":"%b","retries":%rc,"bytes_uploaded":%U,"upstream_response_time":"%Tr","upstream_connect_time":"%Tc","session_duration":"%Tt","termination_state":"%ts","user_agent":"%[capture.req.hdr(1),json("utf8s")]","request_host":"%[capture.req.hdr(2),json("utf8s")]","host":"hostname"}
 
 	# Host ACLs
 
-	acl is_default_foo hdr_beg(host) -i foo.example.com
-	acl is_default_bar hdr_beg(host) -i bar.example.com
+	acl is_default_foo_b920a8e2 hdr_beg(host) -i foo.example.com
+	acl is_default_bar_ebdb5bf3 hdr_beg(host) -i bar.example.com
 
 	# Path ACLs and use_backend
 
-	acl is_default_foo_path path_beg /
-	use_backend default_foo if is_default_foo is_default_foo_path
-	acl is_default_bar_bar_path_path path_beg /bar/path
-	use_backend default_bar_bar_path if is_default_bar is_default_bar_bar_path_path
-	acl is_default_bar_baz_path_path path_beg /baz/path
-	use_backend default_bar_baz_path if is_default_bar is_default_bar_baz_path_path
+	acl is_default_foo_42d5046e_path path_beg /
+	use_backend default_foo_42d5046e if is_default_foo_b920a8e2 is_default_foo_42d5046e_path
+	acl is_default_bar_bar_path_de56f252_path path_beg /bar/path
+	use_backend default_bar_bar_path_de56f252 if is_default_bar_ebdb5bf3 is_default_bar_bar_path_de56f252_path
+	acl is_default_bar_baz_path_aec6cafa_path path_beg /baz/path
+	use_backend default_bar_baz_path_aec6cafa if is_default_bar_ebdb5bf3 is_default_bar_baz_path_aec6cafa_path
 
 	default_backend not_found
 
 
 
-backend default_foo
+backend default_foo_42d5046e
 	# Close connections after the proxy.
 	option http-server-close
 	# Include X-Forward-For header.
 	option forwardfor
 
 	balance leastconn
-	server foo foo.default.svc.cluster.local:3000 resolvers dns
-backend default_bar_bar_path
+	server foo foo.default.svc.cluster.local:3000 resolvers dns check
+backend default_bar_bar_path_de56f252
 	# Close connections after the proxy.
 	option http-server-close
 	# Include X-Forward-For header.
 	option forwardfor
 
 	balance leastconn
-	server bar bar.default.svc.cluster.local:9000 resolvers dns
-backend default_bar_baz_path
+	server bar bar.default.svc.cluster.local:9000 resolvers dns check
+backend default_bar_baz_path_aec6cafa
 	# Close connections after the proxy.
 	option http-server-close
 	# Include X-Forward-For header.
 	option forwardfor
 
 	balance leastconn
-	server bar baz.default.svc.cluster.local:9001 resolvers dns
+	server bar baz.default.svc.cluster.local:9001 resolvers dns check
 `,
 		},
 	}
@@ -451,7 +524,7 @@ backend default_bar_baz_path
 		defer cleanup()
 
 		confPath := dir + "/file"
-		c := NewConfig(&fakeIngress{listResults: test.ingresses}, "hostname", confPath, "example.com")
+		c := NewConfig(&fakeIngress{listResults: test.ingresses}, withServices(&fakeClient{}, test.ingresses), "hostname", confPath, "example.com", Options{})
 
 		changed, err := c.Update()
 		if err != test.err {
@@ -501,6 +574,88 @@ backend default_bar_baz_path
 
 }
 
+func TestUpdateMasterWorker(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		{
+			ObjectMeta: api.ObjectMeta{
+				Name:      "ingress-5",
+				Namespace: "default",
+			},
+		},
+	}
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{MasterWorker: true})
+
+	socket := "stats socket /var/run/haproxy.sock mode 600 level admin expose-fd listeners"
+	if !strings.Contains(contents, socket) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected admin socket exposing listeners")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	ingress := func(host string) extensions.Ingress {
+		return extensions.Ingress{
+			ObjectMeta: api.ObjectMeta{
+				Name:      "ingress-6",
+				Namespace: "default",
+			},
+			Spec: extensions.IngressSpec{
+				Rules: []extensions.IngressRule{
+					{
+						Host: host,
+						IngressRuleValue: extensions.IngressRuleValue{
+							HTTP: &extensions.HTTPIngressRuleValue{
+								Paths: []extensions.HTTPIngressPath{
+									{
+										Path: "/",
+										Backend: extensions.IngressBackend{
+											ServiceName: host,
+											ServicePort: intstr.FromInt(3000),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	confPath := dir + "/file"
+	f := &fakeIngress{}
+	c := NewConfig(f, &fakeClient{}, "hostname", confPath, "example.com", Options{})
+
+	for i, host := range []string{"foo", "bar", "bar"} {
+		f.listResults = []extensions.Ingress{ingress(host)}
+		changed, err := c.Fetch()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if want := i < 2; changed != want {
+			t.Fatalf("%d: want changed %v, got %v", i+1, want, changed)
+		}
+	}
+
+	if err := c.Render(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(contents), "backend default_bar") || strings.Contains(string(contents), "backend default_foo") {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected config for the last fetched ingresses")
+	}
+}
+
 type fakeIngress struct {
 	testclient.FakeIngress
 	listResults []extensions.Ingress
@@ -509,3 +664,361 @@ type fakeIngress struct {
 func (f *fakeIngress) List(lo api.ListOptions) (*extensions.IngressList, error) {
 	return &extensions.IngressList{Items: f.listResults}, nil
 }
+
+// fakeClient looks up objects from its maps, which are keyed by namespace and
+// name.
+type fakeClient struct {
+	services   map[string]*api.Service
+	endpoints  map[string]*api.Endpoints
+	secrets    map[string]*api.Secret
+	configMaps map[string]*api.ConfigMap
+	pods       map[string]*api.Pod
+	// secretsErr, if set, is returned for every secret, as if the API
+	// couldn't be reached.
+	secretsErr error
+	// servicesErr, like secretsErr, is returned for every service.
+	servicesErr error
+	// gets counts the services, endpoints and pods fetched one at a time,
+	// rather than listed.
+	gets int
+}
+
+// withServices gives the client a service for every one the ingresses refer
+// to, unless it has services of its own, so that tests that aren't about
+// services needn't list them.
+func withServices(kube *fakeClient, ingresses []extensions.Ingress) *fakeClient {
+	if kube.services != nil {
+		return kube
+	}
+
+	kube.services = map[string]*api.Service{}
+	add := func(namespace, name string) {
+		kube.services[namespace+"/"+name] = &api.Service{}
+	}
+	for _, i := range ingresses {
+		for _, rule := range i.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for _, path := range rule.HTTP.Paths {
+				add(i.Namespace, path.Backend.ServiceName)
+			}
+		}
+		if canary, ok := i.Annotations[canaryServiceAnnotation]; ok {
+			add(i.Namespace, canary)
+		}
+		if service, ok := i.Annotations[errorServiceAnnotation]; ok {
+			add(i.Namespace, strings.Split(service, ":")[0])
+		}
+	}
+	return kube
+}
+
+// splitKey splits a key of the fake's maps into its namespace and name.
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1]
+}
+
+// inNamespace reports whether the key is of an object in the namespace.
+func inNamespace(key, namespace string) bool {
+	return namespace == api.NamespaceAll || strings.HasPrefix(key, namespace+"/")
+}
+
+// notFoundError returns the error the API returns for a missing object.
+func notFoundError(kind, namespace, name string) error {
+	return &apierrors.StatusError{ErrStatus: apiunversioned.Status{
+		Reason:  apiunversioned.StatusReasonNotFound,
+		Message: fmt.Sprintf("%s %s/%s not found", kind, namespace, name),
+	}}
+}
+
+func (f *fakeClient) Services(namespace string) unversioned.ServiceInterface {
+	return &fakeServices{FakeServices: testclient.FakeServices{Namespace: namespace}, objects: f.services, err: f.servicesErr, gets: &f.gets}
+}
+
+func (f *fakeClient) Endpoints(namespace string) unversioned.EndpointsInterface {
+	return &fakeEndpoints{FakeEndpoints: testclient.FakeEndpoints{Namespace: namespace}, objects: f.endpoints, gets: &f.gets}
+}
+
+func (f *fakeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	return &fakeSecrets{FakeSecrets: testclient.FakeSecrets{Namespace: namespace}, objects: f.secrets, err: f.secretsErr}
+}
+
+func (f *fakeClient) ConfigMaps(namespace string) unversioned.ConfigMapsInterface {
+	return &fakeConfigMaps{FakeConfigMaps: testclient.FakeConfigMaps{Namespace: namespace}, objects: f.configMaps}
+}
+
+func (f *fakeClient) Pods(namespace string) unversioned.PodInterface {
+	return &fakePods{FakePods: testclient.FakePods{Namespace: namespace}, objects: f.pods, gets: &f.gets}
+}
+
+type fakeServices struct {
+	testclient.FakeServices
+	objects map[string]*api.Service
+	err     error
+	gets    *int
+}
+
+func (f *fakeServices) List(opts api.ListOptions) (*api.ServiceList, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	list := &api.ServiceList{}
+	for key, s := range f.objects {
+		if inNamespace(key, f.Namespace) {
+			item := *s
+			item.Namespace, item.Name = splitKey(key)
+			list.Items = append(list.Items, item)
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeServices) Get(name string) (*api.Service, error) {
+	*f.gets++
+	if f.err != nil {
+		return nil, f.err
+	}
+	// Clients without services have every one, so that tests that aren't
+	// about services needn't list them.
+	if f.objects == nil {
+		return &api.Service{ObjectMeta: api.ObjectMeta{Name: name, Namespace: f.Namespace}}, nil
+	}
+	if s, ok := f.objects[f.Namespace+"/"+name]; ok {
+		return s, nil
+	}
+	return nil, notFoundError("service", f.Namespace, name)
+}
+
+type fakeEndpoints struct {
+	testclient.FakeEndpoints
+	objects map[string]*api.Endpoints
+	gets    *int
+}
+
+func (f *fakeEndpoints) List(opts api.ListOptions) (*api.EndpointsList, error) {
+	list := &api.EndpointsList{}
+	for key, e := range f.objects {
+		if inNamespace(key, f.Namespace) {
+			item := *e
+			item.Namespace, item.Name = splitKey(key)
+			list.Items = append(list.Items, item)
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeEndpoints) Get(name string) (*api.Endpoints, error) {
+	*f.gets++
+	if e, ok := f.objects[f.Namespace+"/"+name]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("endpoints %s/%s not found", f.Namespace, name)
+}
+
+type fakeSecrets struct {
+	testclient.FakeSecrets
+	objects map[string]*api.Secret
+	err     error
+}
+
+func (f *fakeSecrets) Get(name string) (*api.Secret, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if s, ok := f.objects[f.Namespace+"/"+name]; ok {
+		return s, nil
+	}
+	return nil, notFoundError("secret", f.Namespace, name)
+}
+
+type fakeConfigMaps struct {
+	testclient.FakeConfigMaps
+	objects map[string]*api.ConfigMap
+}
+
+func (f *fakeConfigMaps) Get(name string) (*api.ConfigMap, error) {
+	if cm, ok := f.objects[f.Namespace+"/"+name]; ok {
+		return cm, nil
+	}
+	return nil, fmt.Errorf("configmap %s/%s not found", f.Namespace, name)
+}
+
+type fakePods struct {
+	testclient.FakePods
+	objects map[string]*api.Pod
+	gets    *int
+}
+
+func (f *fakePods) List(opts api.ListOptions) (*api.PodList, error) {
+	list := &api.PodList{}
+	for key, p := range f.objects {
+		if !inNamespace(key, f.Namespace) {
+			continue
+		}
+		if opts.LabelSelector != nil && !opts.LabelSelector.Matches(labels.Set(p.Labels)) {
+			continue
+		}
+		item := *p
+		item.Namespace, item.Name = splitKey(key)
+		list.Items = append(list.Items, item)
+	}
+	return list, nil
+}
+
+func (f *fakePods) Get(name string) (*api.Pod, error) {
+	*f.gets++
+	if p, ok := f.objects[f.Namespace+"/"+name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("pod %s/%s not found", f.Namespace, name)
+}
+
+func TestFeaturesFromNamedPort(t *testing.T) {
+	named := func(name, service, port string) extensions.Ingress {
+		i := extensions.Ingress{
+			ObjectMeta: api.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					canaryServiceAnnotation:  service + "-canary",
+					canaryByCookieAnnotation: "canary",
+				},
+			},
+			Spec: extensions.IngressSpec{
+				Rules: []extensions.IngressRule{
+					{
+						Host: name,
+						IngressRuleValue: extensions.IngressRuleValue{
+							HTTP: &extensions.HTTPIngressRuleValue{
+								Paths: []extensions.HTTPIngressPath{
+									{
+										Path: "/",
+										Backend: extensions.IngressBackend{
+											ServiceName: service,
+											ServicePort: intstr.FromString(port),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		return i
+	}
+
+	kube := &fakeClient{
+		services: map[string]*api.Service{
+			"default/foo": {
+				Spec: api.ServiceSpec{
+					Ports: []api.ServicePort{
+						{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(9090)},
+						{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+					},
+				},
+			},
+			"default/foo-canary": {
+				Spec: api.ServiceSpec{
+					Ports: []api.ServicePort{
+						{Name: "http", Port: 8000, TargetPort: intstr.FromInt(8080)},
+					},
+				},
+			},
+		},
+	}
+
+	f, err := featuresFrom([]extensions.Ingress{named("foo", "foo", "http"), named("bar", "bar", "http"), named("baz", "foo", "grpc")}, "example.com", "cluster.local", kube)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var addresses []string
+	for _, b := range f.Backends {
+		for _, s := range b.Servers {
+			addresses = append(addresses, s.Address)
+		}
+	}
+
+	expected := []string{
+		"foo.default.svc.cluster.local:80",
+		"foo-canary.default.svc.cluster.local:8000",
+	}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Logf("want: %v", expected)
+		t.Logf(" got: %v", addresses)
+		t.Fatal("unexpected server addresses")
+	}
+
+	// Only the service can resolve a named port, so one that can't be
+	// fetched fails the lookup rather than skipping the path.
+	kube.servicesErr = fmt.Errorf("connection refused")
+	_, err = featuresFrom([]extensions.Ingress{named("foo", "foo", "http")}, "example.com", "cluster.local", kube)
+	if _, ok := err.(LookupError); !ok {
+		t.Fatalf("expected lookup error, got %v", err)
+	}
+}
+
+func TestUpdateExternalService(t *testing.T) {
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{healthCheckPathAnnotation: "/healthz"}),
+	}
+
+	kube := &fakeClient{
+		services: map[string]*api.Service{
+			"default/foo": {
+				ObjectMeta: api.ObjectMeta{
+					Annotations: map[string]string{
+						externalNameAnnotation: "api.example.org",
+						externalTLSAnnotation:  "true",
+					},
+				},
+				Spec: api.ServiceSpec{
+					Ports: []api.ServicePort{{Port: 3000}},
+				},
+			},
+		},
+	}
+
+	contents := renderConfig(t, ingresses, kube, Options{})
+
+	for _, expected := range []string{
+		"\toption httpchk GET /healthz HTTP/1.1\\r\\nHost:\\ api.example.org\n",
+		"\thttp-request set-header Host api.example.org\n",
+		"\tserver foo api.example.org:3000 resolvers dns check ssl verify required ca-file /etc/ssl/certs/ca-certificates.crt sni str(api.example.org)\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+
+	kube.services["default/foo"].Annotations[externalNameAnnotation] = "api.example.org:443 check"
+	if _, err := serviceUpstream(kube, "cluster.local", "default", ingresses[0].Spec.Rules[0].HTTP.Paths[0].Backend); err == nil {
+		t.Fatal("expected invalid external name to be rejected")
+	}
+}
+
+func TestUpdateMissingService(t *testing.T) {
+	ingresses := []extensions.Ingress{annotatedIngress(nil)}
+	kube := &fakeClient{services: map[string]*api.Service{}}
+
+	contents := renderConfig(t, ingresses, kube, Options{})
+
+	for _, expected := range []string{
+		"\tuse_backend default_foo_42d5046e if is_default_foo_b920a8e2 is_default_foo_42d5046e_path\n",
+		"\toption forwardfor\n\t# Service foo doesn't exist yet.\n\thttp-request deny deny_status 503\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+	if strings.Contains(contents, "foo.default.svc.cluster.local") {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected no server for the missing service")
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// errorPageReasons are the statuses that pages can be given for, with their
+// reason phrases. HAProxy has no errorfile for 404, so its page is served by a
+// backend without servers as the 503 page.
+var errorPageReasons = map[int]string{
+	404: "Not Found",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+}
+
+// maxErrorPage is the largest response HAProxy accepts as an errorfile, which
+// has to fit in a buffer less the space reserved for rewrites.
+const maxErrorPage = 16384 - 1024
+
+// errorPage is a generated errorfile for a status.
+type errorPage struct {
+	Status int
+	File   string
+}
+
+// notFound is a backend serving a 404 page for requests to its hosts that
+// match none of their paths.
+type notFound struct {
+	Name, File string
+	HostACLs   []string
+}
+
+// errorPagesFrom returns errorfiles for the pages in a ConfigMap's data, which
+// are HTML keyed by status, adding them to files with the given prefix.
+// Invalid pages are logged and skipped, leaving HAProxy's own.
+func errorPagesFrom(source, prefix string, data map[string]string, files map[string]string) []errorPage {
+	var pages []errorPage
+	for key, body := range data {
+		response, status, err := errorResponse(key, body)
+		if err != nil {
+			log.Printf("skipping error page %s in %s: %v", key, source, err)
+			continue
+		}
+
+		page := errorPage{
+			Status: status,
+			File:   fmt.Sprintf("%s_%d.http", prefix, status),
+		}
+		files[page.File] = response
+		pages = append(pages, page)
+	}
+
+	sort.Sort(byStatus(pages))
+	return pages
+}
+
+// errorResponse returns the HTTP response serving the page for the status in
+// key.
+func errorResponse(key, body string) (string, int, error) {
+	status, err := strconv.Atoi(key)
+	if err != nil || errorPageReasons[status] == "" {
+		return "", 0, fmt.Errorf("unsupported status %q", key)
+	}
+	if !utf8.ValidString(body) {
+		return "", 0, fmt.Errorf("page isn't UTF-8")
+	}
+
+	headers := []string{
+		fmt.Sprintf("HTTP/1.1 %d %s", status, errorPageReasons[status]),
+		"Cache-Control: no-cache",
+		"Connection: close",
+		"Content-Type: text/html; charset=utf-8",
+		"Content-Length: " + strconv.Itoa(len(body)),
+	}
+	response := strings.Join(headers, "\r\n") + "\r\n\r\n" + body
+
+	if len(response) > maxErrorPage {
+		return "", 0, fmt.Errorf("page is %d bytes, more than the %d allowed", len(body), maxErrorPage-len(response)+len(body))
+	}
+	return response, status, nil
+}
+
+// withoutNotFound splits the 404 page, if any, from the others.
+func withoutNotFound(pages []errorPage) ([]errorPage, string) {
+	var others []errorPage
+	var file string
+	for _, p := range pages {
+		if p.Status == 404 {
+			file = p.File
+			continue
+		}
+		others = append(others, p)
+	}
+	return others, file
+}
+
+type byStatus []errorPage
+
+func (s byStatus) Len() int           { return len(s) }
+func (s byStatus) Less(i, j int) bool { return s[i].Status < s[j].Status }
+func (s byStatus) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
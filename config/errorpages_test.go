@@ -0,0 +1,120 @@
+package config
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+)
+
+func TestErrorResponse(t *testing.T) {
+	response, status, err := errorResponse("502", "<p>Déjà vu</p>")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status != 502 {
+		t.Errorf("expected status 502, got %d", status)
+	}
+
+	expected := "HTTP/1.1 502 Bad Gateway\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Length: 16\r\n" +
+		"\r\n" +
+		"<p>Déjà vu</p>"
+	if response != expected {
+		t.Errorf("unexpected response %q", response)
+	}
+
+	for _, test := range []struct{ key, body string }{
+		{"500", "<p>error</p>"},
+		{"50x", "<p>error</p>"},
+		{"503", "\xff"},
+		{"503", strings.Repeat("x", maxErrorPage)},
+	} {
+		if _, _, err := errorResponse(test.key, test.body); err == nil {
+			t.Errorf("expected error for %s page of %d bytes", test.key, len(test.body))
+		}
+	}
+}
+
+func TestUpdateErrorPages(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	ingresses := []extensions.Ingress{
+		annotatedIngress(map[string]string{errorPagesAnnotation: "foo-errors"}),
+	}
+
+	kube := &fakeClient{
+		configMaps: map[string]*api.ConfigMap{
+			"kube-system/error-pages": {
+				Data: map[string]string{
+					"404": "<p>Not found</p>",
+					"503": "<p>Unavailable</p>",
+					"418": "<p>Teapot</p>",
+				},
+			},
+			"default/foo-errors": {
+				Data: map[string]string{
+					"404": "<p>Foo not found</p>",
+					"502": "<p>Foo is down</p>",
+				},
+			},
+		},
+	}
+
+	confPath := dir + "/file"
+	c := NewConfig(&fakeIngress{listResults: ingresses}, withServices(kube, ingresses), "hostname", confPath, "example.com", Options{ErrorPages: "kube-system/error-pages"})
+	if _, err := c.Update(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	generated := dir + "/" + generatedDir
+	for _, expected := range []string{
+		"\toption dontlognull\n\terrorfile 503 " + generated + "/errors_503.http\n",
+		"backend not_found\n\t# This seems abusive.\n\terrorfile 503 " + generated + "/errors_404.http\n",
+		"\tuse_backend default_foo_42d5046e if is_default_foo_b920a8e2 is_default_foo_42d5046e_path\n\tuse_backend default_foo_d9ff28a9_not_found if is_default_foo_b920a8e2\n",
+		"\terrorfile 502 " + generated + "/default_foo_d9ff28a9_errors_502.http\n",
+		"backend default_foo_d9ff28a9_not_found\n\terrorfile 503 " + generated + "/default_foo_d9ff28a9_errors_404.http",
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+
+	files, err := ioutil.ReadDir(generated)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("expected 4 error pages, got %d", len(files))
+	}
+
+	page, err := ioutil.ReadFile(generated + "/default_foo_d9ff28a9_errors_404.http")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(page), "HTTP/1.1 404 Not Found\r\n") || !strings.HasSuffix(string(page), "Content-Length: 20\r\n\r\n<p>Foo not found</p>") {
+		t.Fatalf("unexpected page %q", page)
+	}
+
+	// A failed lookup keeps the pages rather than falling back to HAProxy's.
+	delete(kube.configMaps, "kube-system/error-pages")
+	changed, err := c.Fetch()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed {
+		t.Error("expected error pages to be kept when the configmap can't be fetched")
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// listedClient is a Client that looks up services, endpoints and pods in
+// lists fetched once for every Fetch, rather than fetching them for every
+// path. Secrets and ConfigMaps, which few ingresses refer to, are fetched
+// from the Client it wraps.
+type listedClient struct {
+	Client
+	// services and endpoints are keyed by namespace and name, and pods by
+	// namespace.
+	services  map[string]*api.Service
+	endpoints map[string]*api.Endpoints
+	pods      map[string][]api.Pod
+}
+
+// listClient lists the services, endpoints and pods in every namespace.
+func listClient(kube Client) (*listedClient, error) {
+	services, err := kube.Services(api.NamespaceAll).List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := kube.Endpoints(api.NamespaceAll).List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := kube.Pods(api.NamespaceAll).List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listedClient{
+		Client:    kube,
+		services:  map[string]*api.Service{},
+		endpoints: map[string]*api.Endpoints{},
+		pods:      map[string][]api.Pod{},
+	}
+	for i := range services.Items {
+		s := &services.Items[i]
+		l.services[s.Namespace+"/"+s.Name] = s
+	}
+	for i := range endpoints.Items {
+		e := &endpoints.Items[i]
+		l.endpoints[e.Namespace+"/"+e.Name] = e
+	}
+	for _, p := range pods.Items {
+		l.pods[p.Namespace] = append(l.pods[p.Namespace], p)
+	}
+	return l, nil
+}
+
+func (l *listedClient) Services(namespace string) unversioned.ServiceInterface {
+	return listedServices{ServiceInterface: l.Client.Services(namespace), namespace: namespace, objects: l.services}
+}
+
+func (l *listedClient) Endpoints(namespace string) unversioned.EndpointsInterface {
+	return listedEndpoints{EndpointsInterface: l.Client.Endpoints(namespace), namespace: namespace, objects: l.endpoints}
+}
+
+func (l *listedClient) Pods(namespace string) unversioned.PodInterface {
+	return listedPods{PodInterface: l.Client.Pods(namespace), pods: l.pods[namespace]}
+}
+
+type listedServices struct {
+	unversioned.ServiceInterface
+	namespace string
+	objects   map[string]*api.Service
+}
+
+func (s listedServices) Get(name string) (*api.Service, error) {
+	if svc, ok := s.objects[s.namespace+"/"+name]; ok {
+		return svc, nil
+	}
+	return nil, apierrors.NewNotFound(api.Resource("services"), name)
+}
+
+type listedEndpoints struct {
+	unversioned.EndpointsInterface
+	namespace string
+	objects   map[string]*api.Endpoints
+}
+
+func (e listedEndpoints) Get(name string) (*api.Endpoints, error) {
+	if ep, ok := e.objects[e.namespace+"/"+name]; ok {
+		return ep, nil
+	}
+	return nil, apierrors.NewNotFound(api.Resource("endpoints"), name)
+}
+
+type listedPods struct {
+	unversioned.PodInterface
+	pods []api.Pod
+}
+
+// List returns the namespace's pods matching the label selector, if any.
+func (p listedPods) List(opts api.ListOptions) (*api.PodList, error) {
+	list := &api.PodList{}
+	for _, pod := range p.pods {
+		if opts.LabelSelector == nil || opts.LabelSelector.Matches(labels.Set(pod.Labels)) {
+			list.Items = append(list.Items, pod)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+var (
+	validUser = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+	// Passwords are crypt(3) hashes, which HAProxy checks with the system's
+	// crypt. Apache's MD5 and SHA1 schemes aren't supported by it.
+	validPassword = regexp.MustCompile(`^\$(1|2a|2b|2y|5|6)\$[A-Za-z0-9./$=,]+$`)
+)
+
+// servicePort returns the port of the backend's service that the backend
+// refers to, by number or by name. A service that can't be fetched, rather
+// than being missing, is a LookupError.
+func servicePort(kube Client, namespace string, b extensions.IngressBackend) (api.ServicePort, error) {
+	svc, err := kube.Services(namespace).Get(b.ServiceName)
+	switch {
+	case apierrors.IsNotFound(err):
+		return api.ServicePort{}, err
+	case err != nil:
+		return api.ServicePort{}, LookupError{err}
+	}
+
+	for _, p := range svc.Spec.Ports {
+		switch b.ServicePort.Type {
+		case intstr.Int:
+			if p.Port == b.ServicePort.IntValue() {
+				return p, nil
+			}
+		case intstr.String:
+			if p.Name == b.ServicePort.StrVal {
+				return p, nil
+			}
+		}
+	}
+
+	return api.ServicePort{}, fmt.Errorf("service %s/%s has no port %s", namespace, b.ServiceName, b.ServicePort.String())
+}
+
+// servicePortNumber returns the number of the backend's service port. Ports
+// referred to by name are looked up in the service, since HAProxy needs a
+// number.
+func servicePortNumber(kube Client, namespace string, b extensions.IngressBackend) (int, error) {
+	if b.ServicePort.Type == intstr.Int {
+		return b.ServicePort.IntValue(), nil
+	}
+
+	p, err := servicePort(kube, namespace, b)
+	if err != nil {
+		return 0, err
+	}
+	return p.Port, nil
+}
+
+// upstream is where requests for a service's port are sent.
+type upstream struct {
+	Address string
+	// Host is the name of the external host the service stands for, if it
+	// does, which is sent as the Host header and, with TLS, as the SNI.
+	Host string
+	TLS  bool
+}
+
+// serviceUpstream returns the upstream of the backend's service port, which
+// is the service's cluster name unless it stands for an external host. A
+// service that doesn't exist is an error, since its name wouldn't resolve,
+// but one that can't be fetched otherwise is assumed to be in the cluster,
+// unless its port is referred to by name, which only it can resolve.
+func serviceUpstream(kube Client, clusterDomain, namespace string, b extensions.IngressBackend) (upstream, error) {
+	svc, err := kube.Services(namespace).Get(b.ServiceName)
+	switch {
+	case apierrors.IsNotFound(err):
+		return upstream{}, err
+	case err != nil:
+		svc = &api.Service{}
+	}
+
+	port, err := servicePortNumber(kube, namespace, b)
+	if err != nil {
+		return upstream{}, err
+	}
+
+	u := upstream{Address: serviceAddress(b.ServiceName, namespace, clusterDomain, port)}
+	host, ok := svc.Annotations[externalNameAnnotation]
+	if !ok {
+		return u, nil
+	}
+	if !validSubdomain.MatchString(host) {
+		return upstream{}, fmt.Errorf("service %s/%s: invalid %s: %q", namespace, b.ServiceName, externalNameAnnotation, host)
+	}
+
+	u.Address = fmt.Sprintf("%s:%d", host, port)
+	u.Host = host
+	u.TLS = svc.Annotations[externalTLSAnnotation] == "true"
+	return u, nil
+}
+
+// server returns a server with the given name for the upstream.
+func (u upstream) server(name string) server {
+	s := server{Name: name, Address: u.Address}
+	if u.TLS {
+		s.SNI = u.Host
+	}
+	return s
+}
+
+// podServers returns a server for every ready pod behind the backend's
+// service. Each is given a cookie derived from the pod, so that it's the same
+// across reloads and replicas of hing.
+func podServers(kube Client, namespace string, b extensions.IngressBackend) ([]server, error) {
+	port, err := servicePort(kube, namespace, b)
+	if err != nil {
+		return nil, err
+	}
+
+	ep, err := kube.Endpoints(namespace).Get(b.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []server
+	for _, subset := range ep.Subsets {
+		for _, p := range subset.Ports {
+			if p.Name != port.Name {
+				continue
+			}
+
+			for _, addr := range subset.Addresses {
+				name := addr.IP
+				if addr.TargetRef != nil {
+					name = addr.TargetRef.Name
+				}
+
+				servers = append(servers, server{
+					Name:    name,
+					Address: fmt.Sprintf("%s:%d", addr.IP, p.Port),
+					Cookie:  podCookie(namespace, name),
+				})
+			}
+		}
+	}
+
+	// Endpoints aren't ordered, so sort them to keep the config stable.
+	sort.Sort(byName(servers))
+	return servers, nil
+}
+
+func podCookie(namespace, name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(namespace + "/" + name))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+type byName []server
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// secretUsers returns the users in the "auth" key of the named secret, which
+// is in htpasswd format. Failing to fetch the secret, other than it not
+// existing, is a LookupError.
+func secretUsers(kube Client, namespace, name string) ([]user, error) {
+	secret, err := kube.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, LookupError{err}
+	}
+
+	data, ok := secret.Data["auth"]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no auth key", namespace, name)
+	}
+
+	var users []user
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		entry := strings.TrimSpace(s.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || !validUser.MatchString(parts[0]) || !validPassword.MatchString(parts[1]) {
+			return nil, fmt.Errorf("secret %s/%s: invalid user on line %d, passwords must be crypt(3) hashes", namespace, name, line)
+		}
+
+		users = append(users, user{Name: parts[0], Password: parts[1]})
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("secret %s/%s has no users", namespace, name)
+	}
+	return users, nil
+}
+
+// readinessCheck returns a health check from the readiness probe of the pods
+// the backend's service selects, if it's an HTTP GET on the port served. The
+// first pod by name is assumed to be like the rest. Whether it's ready doesn't
+// matter, so that the check, and with it the config, doesn't change as pods
+// become ready or not.
+func readinessCheck(kube Client, namespace string, b extensions.IngressBackend) (*healthCheck, error) {
+	svc, err := kube.Services(namespace).Get(b.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("service %s/%s has no selector", namespace, b.ServiceName)
+	}
+
+	port, err := servicePort(kube, namespace, b)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := kube.Pods(namespace).List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set(svc.Spec.Selector)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("service %s/%s has no pods", namespace, b.ServiceName)
+	}
+
+	sort.Sort(podsByName(pods.Items))
+	pod := &pods.Items[0]
+	return probeCheck(pod, targetPort(pod, port)), nil
+}
+
+// targetPort returns the number of the pod's port that the service port
+// forwards to, which is referred to by number or by name.
+func targetPort(pod *api.Pod, port api.ServicePort) int {
+	if port.TargetPort.Type == intstr.String {
+		for _, c := range pod.Spec.Containers {
+			if n := containerPort(c, port.TargetPort); n != 0 {
+				return n
+			}
+		}
+		return 0
+	}
+
+	if port.TargetPort.IntValue() == 0 {
+		return port.Port
+	}
+	return port.TargetPort.IntValue()
+}
+
+type podsByName []api.Pod
+
+func (p podsByName) Len() int           { return len(p) }
+func (p podsByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p podsByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
+// probeCheck returns a health check from the pod's readiness probe on port, or
+// nil if it doesn't have one HAProxy can make.
+func probeCheck(pod *api.Pod, port int) *healthCheck {
+	for _, c := range pod.Spec.Containers {
+		probe := c.ReadinessProbe
+		if probe == nil || probe.HTTPGet == nil {
+			continue
+		}
+
+		get := probe.HTTPGet
+		if get.Host != "" || get.Scheme == api.URISchemeHTTPS || containerPort(c, get.Port) != port {
+			continue
+		}
+		if get.Path != "" && !validCheckPath.MatchString(get.Path) {
+			continue
+		}
+
+		hc := &healthCheck{
+			Method:   "GET",
+			Path:     get.Path,
+			Interval: probe.PeriodSeconds,
+			Rise:     probe.SuccessThreshold,
+			Fall:     probe.FailureThreshold,
+		}
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		return hc
+	}
+	return nil
+}
+
+// containerPort returns the number of the container's port, which is referred
+// to by number or by name.
+func containerPort(c api.Container, port intstr.IntOrString) int {
+	if port.Type == intstr.Int {
+		return port.IntValue()
+	}
+
+	for _, p := range c.Ports {
+		if p.Name == port.StrVal {
+			return p.ContainerPort
+		}
+	}
+	return 0
+}
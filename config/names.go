@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// maxNamePrefix is the longest the readable part of a name can be. With the
+// hash and the suffixes added for related backends and ACLs, names stay well
+// within what HAProxy and its logs handle.
+const maxNamePrefix = 48
+
+// uniqueName returns a name for the object of the given kind identified by
+// parts. It starts with the readable prefix, shortened if need be, and ends in
+// a hash of the kind and parts, so that it's the same across reloads and
+// different for objects whose prefixes are the same.
+func uniqueName(prefix, kind string, parts ...string) string {
+	// Paths may have characters HAProxy doesn't allow in names.
+	prefix = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(prefix))
+	if len(prefix) > maxNamePrefix {
+		prefix = strings.TrimRight(prefix[:maxNamePrefix], "_")
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(kind))
+	for _, p := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(p))
+	}
+	return fmt.Sprintf("%s_%08x", prefix, h.Sum32())
+}
+
+// routeName returns the name of the backend for a path of a host.
+func routeName(namespace, host, path string) string {
+	return uniqueName(canonicalizedName(namespace, host, path), "route", namespace, host, path)
+}
+
+// hostName returns the name the host's ACL is based on.
+func hostName(namespace, host string) string {
+	return uniqueName(canonicalizedNamespaceHost(namespace, host), "host", namespace, host)
+}
+
+// ingressName returns the name that the ingress's own backends and ACLs are
+// based on.
+func ingressName(namespace, name string) string {
+	return uniqueName(canonicalizedNamespaceHost(namespace, name), "ingress", namespace, name)
+}
+
+// secretName returns the name of the userlist for a secret.
+func secretName(namespace, secret string) string {
+	return uniqueName(canonicalizedNamespaceHost(namespace, secret), "secret", namespace, secret)
+}
+
+// claim records that name is used by the object identified by key. It reports
+// whether the same object already has it, and returns an error if another
+// object does, which would have them share a backend or ACL.
+func (f *features) claim(name, key string) (bool, error) {
+	if f.names == nil {
+		f.names = map[string]string{}
+	}
+
+	existing, ok := f.names[name]
+	switch {
+	case !ok:
+		f.names[name] = key
+		return false, nil
+	case existing == key:
+		return true, nil
+	default:
+		return false, fmt.Errorf("name %s of %s collides with %s", name, key, existing)
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/apis/extensions"
+)
+
+func TestRouteName(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b [3]string
+	}{
+		{"slash and underscore in path", [3]string{"default", "foo", "/a/b"}, [3]string{"default", "foo", "/a_b"}},
+		{"dot and underscore in path", [3]string{"default", "foo", "/a.b"}, [3]string{"default", "foo", "/a_b"}},
+		{"host and path", [3]string{"default", "a.b", "/"}, [3]string{"default", "a", "/b"}},
+		{"namespace and host", [3]string{"a-b", "c", "/"}, [3]string{"a", "b-c", "/"}},
+		{"case", [3]string{"default", "foo", "/A"}, [3]string{"default", "foo", "/a"}},
+	}
+
+	for i, test := range tests {
+		a := routeName(test.a[0], test.a[1], test.a[2])
+		b := routeName(test.b[0], test.b[1], test.b[2])
+		if a == b {
+			t.Errorf("%d: %s: both named %s", i+1, test.name, a)
+		}
+	}
+
+	if routeName("default", "foo", "/") != routeName("default", "foo", "/") {
+		t.Error("expected names to be stable")
+	}
+
+	long := routeName("a-namespace-that-is-long", strings.Repeat("sub.", 20)+"example.com", "/"+strings.Repeat("x", 200)+"/(y)")
+	if len(long) != maxNamePrefix+9 || strings.ContainsAny(long, "/()") {
+		t.Errorf("unexpected name %q", long)
+	}
+}
+
+func TestFeaturesFromDuplicatePath(t *testing.T) {
+	first := annotatedIngress(nil)
+	second := annotatedIngress(nil)
+	second.Name = "bar"
+	second.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName = "bar"
+
+	f, err := featuresFrom([]extensions.Ingress{first, second}, "example.com", "cluster.local", &fakeClient{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(f.Backends) != 1 || f.Backends[0].Servers[0].Name != "foo" {
+		t.Fatalf("expected only the first ingress's backend, got %#v", f.Backends)
+	}
+	if len(f.Frontends) != 1 {
+		t.Fatalf("expected one frontend, got %d", len(f.Frontends))
+	}
+}
+
+func TestClaim(t *testing.T) {
+	f := &features{}
+	if exists, err := f.claim("foo", "host default/foo"); exists || err != nil {
+		t.Fatalf("unexpected claim: %v, %v", exists, err)
+	}
+	if exists, err := f.claim("foo", "host default/foo"); !exists || err != nil {
+		t.Fatalf("expected the same host to share its name: %v, %v", exists, err)
+	}
+	if _, err := f.claim("foo", "path default/foo/"); err == nil {
+		t.Fatal("expected collision to be reported")
+	}
+}
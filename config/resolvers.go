@@ -0,0 +1,64 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// HAProxy resolves service names at runtime with the nameservers in its
+// resolvers section. It can't read them from resolv.conf itself until 1.9, so
+// they're rendered from the options.
+
+// ReadNameservers returns the nameservers in the resolv.conf at path. Those
+// HAProxy can't use, like link-local addresses with a zone, are logged and
+// skipped.
+func ReadNameservers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nameservers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if net.ParseIP(fields[1]) == nil {
+			log.Printf("skipping nameserver %q in %s: not an IP address", fields[1], path)
+			continue
+		}
+		nameservers = append(nameservers, fields[1])
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("%s has no usable nameservers", path)
+	}
+	return nameservers, nil
+}
+
+// ParseNameservers returns the nameservers in a comma or space separated list
+// of IP addresses.
+func ParseNameservers(list string) ([]string, error) {
+	nameservers := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no nameservers in %q", list)
+	}
+	return nameservers, nil
+}
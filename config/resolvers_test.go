@@ -0,0 +1,97 @@
+package config
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/apis/extensions"
+)
+
+func TestReadNameservers(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		contents string
+		expected []string
+	}{
+		{
+			"search default.svc.cluster.local svc.cluster.local cluster.local\nnameserver 10.96.0.10\noptions ndots:5\n",
+			[]string{"10.96.0.10"},
+		},
+		{
+			"# resolvers\nnameserver 10.0.0.2\n\nnameserver fd00::a\n",
+			[]string{"10.0.0.2", "fd00::a"},
+		},
+		{
+			"nameserver fe80::1%eth0\nnameserver 10.0.0.2\n",
+			[]string{"10.0.0.2"},
+		},
+		{"nameserver dns.example.com\n", nil},
+		{"search cluster.local\n", nil},
+	}
+
+	for i, test := range tests {
+		path := dir + "/resolv.conf"
+		if err := ioutil.WriteFile(path, []byte(test.contents), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		outcome, err := ReadNameservers(path)
+		if test.expected == nil && err == nil {
+			t.Errorf("%d: expected error, got %v", i+1, outcome)
+			continue
+		}
+		if !reflect.DeepEqual(outcome, test.expected) {
+			t.Logf("want: %v", test.expected)
+			t.Logf(" got: %v", outcome)
+			t.Errorf("%d: outcome did not match expected", i+1)
+		}
+	}
+}
+
+func TestParseNameservers(t *testing.T) {
+	outcome, err := ParseNameservers("10.0.0.2, 10.0.0.3 fd00::a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"10.0.0.2", "10.0.0.3", "fd00::a"}
+	if !reflect.DeepEqual(outcome, expected) {
+		t.Logf("want: %v", expected)
+		t.Logf(" got: %v", outcome)
+		t.Error("outcome did not match expected")
+	}
+
+	if _, err := ParseNameservers("10.0.0.2:53"); err == nil {
+		t.Error("expected error for nameserver with port")
+	}
+
+	if _, err := ParseNameservers(","); err == nil {
+		t.Error("expected error for empty list")
+	}
+}
+
+func TestUpdateResolvers(t *testing.T) {
+	ingresses := []extensions.Ingress{annotatedIngress(nil)}
+
+	contents := renderConfig(t, ingresses, &fakeClient{}, Options{
+		ClusterDomain:   "k8s.example.org",
+		Nameservers:     []string{"10.96.0.10", "fd00::a"},
+		ResolverHold:    30 * time.Second,
+		ResolverTimeout: 500 * time.Millisecond,
+	})
+
+	for _, expected := range []string{
+		"resolvers dns\n\tnameserver ns0 10.96.0.10:53\n\tnameserver ns1 fd00::a:53\n\thold valid 30s\n\ttimeout retry 500ms\n",
+		"\tserver foo foo.default.svc.k8s.example.org:3000 resolvers dns",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Logf("config:\n%s", contents)
+			t.Fatalf("expected %q in config", expected)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// defaultClientTimeout and defaultServerTimeout are the timeouts in the
+// defaults section, in seconds.
+const (
+	defaultClientTimeout = 60
+	defaultServerTimeout = 150
+)
+
+// reservedPorts are bound by the rest of the config, the HTTP frontend and the
+// stats listener, so TCP services can't use them. Nor can they use the status
+// port, which hing itself listens on.
+var reservedPorts = map[int]bool{
+	80:   true,
+	3000: true,
+}
+
+// tcpService is a TCP frontend and backend forwarding a port to a service.
+// They're configured in a ConfigMap mapping ports to entries of the form
+//
+//	<namespace>/<service>:<port> [send-proxy|send-proxy-v2] [timeout-client=<seconds>] [timeout-server=<seconds>]
+//
+// send-proxy and send-proxy-v2 have HAProxy send the PROXY protocol to the
+// service, so it sees the client's address. The timeouts are how long either
+// side may be idle, overriding the defaults.
+type tcpService struct {
+	Name    string
+	Port    int
+	Address string
+	// SendProxy is the server option sending the PROXY protocol, if any.
+	SendProxy string
+	// ClientTimeout and ServerTimeout are in seconds, or 0 for the defaults.
+	ClientTimeout, ServerTimeout int
+	// TunnelTimeout is the larger of the two, in seconds. Once connected,
+	// HAProxy uses the tunnel timeout for both sides in place of the others,
+	// so it's set rather than left to the one for upgraded HTTP connections.
+	TunnelTimeout int
+}
+
+// tcpServicesFrom returns the TCP services in a ConfigMap's data, sorted by
+// port. Invalid entries, and entries for reserved ports or the status port,
+// are logged and skipped. A service that can't be looked up is a LookupError.
+func tcpServicesFrom(kube Client, clusterDomain string, statusPort int, data map[string]string) ([]tcpService, error) {
+	var services []tcpService
+	for port, entry := range data {
+		s, err := tcpServiceFrom(kube, clusterDomain, statusPort, port, entry)
+		if _, ok := err.(LookupError); ok {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("skipping tcp service on port %s: %v", port, err)
+			continue
+		}
+		services = append(services, s)
+	}
+
+	sort.Sort(byPort(services))
+	return services, nil
+}
+
+func tcpServiceFrom(kube Client, clusterDomain string, statusPort int, port, entry string) (tcpService, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return tcpService{}, fmt.Errorf("invalid port %q", port)
+	}
+	if reservedPorts[p] || p == statusPort {
+		return tcpService{}, fmt.Errorf("port %d is already in use", p)
+	}
+
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return tcpService{}, fmt.Errorf("no service")
+	}
+
+	s := tcpService{
+		Name: fmt.Sprintf("tcp_%d", p),
+		Port: p,
+	}
+
+	namespace, service, servicePort, err := splitServiceRef(fields[0])
+	if err != nil {
+		return tcpService{}, err
+	}
+	u, err := serviceUpstream(kube, clusterDomain, namespace, extensions.IngressBackend{
+		ServiceName: service,
+		ServicePort: servicePort,
+	})
+	if err != nil {
+		return tcpService{}, err
+	}
+	s.Address = u.Address
+
+	for _, option := range fields[1:] {
+		switch {
+		case option == "send-proxy" || option == "send-proxy-v2":
+			s.SendProxy = option
+		case strings.HasPrefix(option, "timeout-client="):
+			s.ClientTimeout, err = timeoutOption(option)
+		case strings.HasPrefix(option, "timeout-server="):
+			s.ServerTimeout, err = timeoutOption(option)
+		default:
+			err = fmt.Errorf("unknown option %q", option)
+		}
+		if err != nil {
+			return tcpService{}, err
+		}
+	}
+
+	client, server := s.ClientTimeout, s.ServerTimeout
+	if client == 0 {
+		client = defaultClientTimeout
+	}
+	if server == 0 {
+		server = defaultServerTimeout
+	}
+	s.TunnelTimeout = client
+	if server > client {
+		s.TunnelTimeout = server
+	}
+
+	return s, nil
+}
+
+// splitServiceRef splits a reference of the form <namespace>/<service>:<port>.
+func splitServiceRef(ref string) (namespace, service string, port intstr.IntOrString, err error) {
+	slash := strings.Index(ref, "/")
+	colon := strings.LastIndex(ref, ":")
+	if slash < 0 || colon < slash {
+		return "", "", port, fmt.Errorf("%q is not of the form <namespace>/<service>:<port>", ref)
+	}
+
+	namespace, service = ref[:slash], ref[slash+1:colon]
+	if !validNamespace.MatchString(namespace) {
+		return "", "", port, fmt.Errorf("invalid namespace %q", namespace)
+	}
+	if !validServiceName.MatchString(service) {
+		return "", "", port, fmt.Errorf("invalid service %q", service)
+	}
+
+	// Ports are referred to by number or by name, as in ingresses.
+	p := ref[colon+1:]
+	if n, err := strconv.Atoi(p); err == nil {
+		if n <= 0 || n > 65535 {
+			return "", "", port, fmt.Errorf("invalid service port %q", p)
+		}
+		port = intstr.FromInt(n)
+	} else if validServiceName.MatchString(p) {
+		port = intstr.FromString(p)
+	} else {
+		return "", "", port, fmt.Errorf("invalid service port %q", p)
+	}
+
+	return namespace, service, port, nil
+}
+
+func timeoutOption(option string) (int, error) {
+	value := option[strings.Index(option, "=")+1:]
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds", option)
+	}
+	return seconds, nil
+}
+
+type byPort []tcpService
+
+func (p byPort) Len() int           { return len(p) }
+func (p byPort) Less(i, j int) bool { return p[i].Port < p[j].Port }
+func (p byPort) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestTCPServicesFrom(t *testing.T) {
+	data := map[string]string{
+		"5432": "db/postgres:5432",
+		"1883": "iot/mqtt:mqtt send-proxy-v2 timeout-client=3600 timeout-server=3600",
+		"25":   "mail/smtp:25 timeout-server=60",
+		"80":   "default/web:80",
+		"3000": "default/web:80",
+		"8080": "default/web:80",
+		"abc":  "default/web:80",
+		"2525": "mail/smtp",
+		"2526": "mail/smtp:0",
+		"2527": "mail/smtp:25 send-proxy-v3",
+		"2528": "mail/smtp:25\nbind :81",
+		"2529": "Mail/smtp:25",
+		"2530": "mail/smtp:25 timeout-client=1h",
+		"2531": "iot/mqtt:mqtts",
+		"2532": "db/missing:5432",
+	}
+
+	expected := []tcpService{
+		{
+			Name:          "tcp_25",
+			Port:          25,
+			Address:       "smtp.mail.svc.cluster.local:25",
+			ServerTimeout: 60,
+			TunnelTimeout: 60,
+		},
+		{
+			Name:          "tcp_1883",
+			Port:          1883,
+			Address:       "mqtt.iot.svc.cluster.local:1883",
+			SendProxy:     "send-proxy-v2",
+			ClientTimeout: 3600,
+			ServerTimeout: 3600,
+			TunnelTimeout: 3600,
+		},
+		{
+			Name:          "tcp_5432",
+			Port:          5432,
+			Address:       "postgres.db.svc.cluster.local:5432",
+			TunnelTimeout: 150,
+		},
+	}
+
+	kube := &fakeClient{
+		services: map[string]*api.Service{
+			"iot/mqtt": {
+				Spec: api.ServiceSpec{
+					Ports: []api.ServicePort{{Name: "mqtt", Port: 1883}},
+				},
+			},
+			"db/postgres": {},
+			"mail/smtp":   {},
+		},
+	}
+
+	outcome, err := tcpServicesFrom(kube, "cluster.local", 8080, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(outcome, expected) {
+		t.Logf("want: %#v", expected)
+		t.Logf(" got: %#v", outcome)
+		t.Error("outcome did not match expected")
+	}
+}
+
+func TestUpdateTCPServices(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	kube := &fakeClient{
+		configMaps: map[string]*api.ConfigMap{
+			"kube-system/tcp-services": {
+				Data: map[string]string{"5432": "db/postgres:5432 send-proxy timeout-client=600"},
+			},
+		},
+		services: map[string]*api.Service{
+			"db/postgres": {},
+		},
+	}
+
+	confPath := dir + "/file"
+	c := NewConfig(&fakeIngress{}, kube, "hostname", confPath, "example.com", Options{TCPServices: "kube-system/tcp-services"})
+	if _, err := c.Update(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `
+frontend tcp_5432
+	bind :5432
+	mode tcp
+	option tcplog
+	timeout client 600s
+	default_backend tcp_5432
+
+backend tcp_5432
+	mode tcp
+	timeout tunnel 600s
+	server tcp_5432 postgres.db.svc.cluster.local:5432 resolvers dns check send-proxy
+`
+	if !strings.HasSuffix(string(contents), expected) {
+		t.Logf("config:\n%s", contents)
+		t.Fatal("expected tcp service frontend and backend")
+	}
+
+	// A failed lookup keeps the services rather than cutting their
+	// connections.
+	delete(kube.configMaps, "kube-system/tcp-services")
+	changed, err := c.Fetch()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed {
+		t.Error("expected tcp services to be kept when the configmap can't be fetched")
+	}
+}
@@ -9,7 +9,8 @@ global
 	log 127.0.0.1 local0
 	tune.bufsize 16384
 	tune.maxrewrite 1024
-	spread-checks 4
+	spread-checks 4{{if .MasterWorker}}
+	stats socket /var/run/haproxy.sock mode 600 level admin expose-fd listeners{{end}}
 
 defaults
 	log global
@@ -20,9 +21,15 @@ defaults
 	timeout queue 60s
 	timeout http-request 15s
 	timeout http-keep-alive 15s
+	# Upgraded connections, like WebSockets, are idle for longer than requests.
+	timeout tunnel {{.TunnelTimeout}}s
+	# Servers whose names don't resolve yet are started without an address,
+	# rather than failing the reload, and resolved at runtime.
+	default-server init-addr last,libc,none
 	option httplog
 	option redispatch
-	option dontlognull
+	option dontlognull{{range $p := .ErrorPages}}
+	errorfile {{$p.Status}} {{$.Dir}}/{{$p.File}}{{end}}
 
 listen stats
 	bind 127.0.0.1:3000
@@ -30,12 +37,17 @@ listen stats
 	stats enable
 	stats uri /
 
-resolvers dns
-	hold valid 10s
-
+resolvers dns{{range $n, $ns := .Nameservers}}
+	nameserver ns{{$n}} {{$ns}}:53{{end}}
+	hold valid {{.ResolverHold}}s
+	timeout retry {{.ResolverTimeout}}ms
+{{ range $ul := .Userlists }}
+userlist {{$ul.Name}}{{range $u := $ul.Users}}
+	user {{$u.Name}} password {{$u.Password}}{{end}}
+{{end}}
 backend not_found
 	# This seems abusive.
-	errorfile 503 /etc/haproxy/errors/not_found.http
+	errorfile 503 {{if .NotFoundPage}}{{$.Dir}}/{{.NotFoundPage}}{{else}}/etc/haproxy/errors/not_found.http{{end}}
 
 frontend ingress
 	bind :80
@@ -44,6 +56,17 @@ frontend ingress
 	capture request header User-Agent len 128
 	capture request header Host len 64
 
+	# Requests are given an id, which servers and error services are passed.
+	unique-id-format %{+X}o\ %ci:%cp_%fi:%fp_%Ts_%rt:%pid
+	unique-id-header X-Request-ID
+
+	# Upgrade requests have the connection tunnelled once the server switches
+	# protocols. Clients may also ask for keep-alive, which would otherwise
+	# have the tunnel handled as an ordinary keep-alive connection.
+	acl is_upgrade hdr(connection) -m sub -i upgrade
+	acl is_upgrade_protocol req.hdr(upgrade) -m found
+	http-request set-header Connection upgrade if is_upgrade is_upgrade_protocol
+
 	# JSON logging for ES: http://www.rsyslog.com/json-elasticsearch/
 	log-format @cee:{"program":"haproxy","timestamp":%Ts,"http_status":%ST,"http_request":"%r","remote_addr":"%ci","bytes_read":%B,"upstream_addr":"%si","backend_name":"%b","retries":%rc,"bytes_uploaded":%U,"upstream_response_time":"%Tr","upstream_connect_time":"%Tc","session_duration":"%Tt","termination_state":"%ts","user_agent":"%[capture.req.hdr(1),json("utf8s")]","request_host":"%[capture.req.hdr(2),json("utf8s")]","host":"{{.Hostname}}"}
 
@@ -52,9 +75,14 @@ frontend ingress
 	acl {{$acl.Name}} {{$acl.Matcher}}{{end}}
 
 	# Path ACLs and use_backend
-{{ range $fe := .Frontends }}
-	acl {{$fe.PathACL.Name}} {{$fe.PathACL.Matcher}}
-	use_backend {{$fe.Backend.Name}} if {{$fe.HostACL.Name}} {{$fe.PathACL.Name}}{{end}}
+{{ range $r := .ErrorRoutes }}
+	use_backend {{$r.Backend}} if {{$r.HostACL}} { path_beg {{$r.Path}} }{{end}}{{ range $fe := .Frontends }}
+	acl {{$fe.PathACL.Name}} {{$fe.PathACL.Matcher}}{{with $c := $fe.Canary}}{{range $m := $c.Matchers}}
+	acl {{$c.ACLName}} {{$m}}{{end}}
+	use_backend {{$c.Backend.Name}} if {{$fe.HostACL.Name}} {{$fe.PathACL.Name}} {{$c.ACLName}}{{end}}{{range $p := $fe.Preflights}}
+	use_backend {{$p.Backend}} if {{$fe.HostACL.Name}} {{$fe.PathACL.Name}} METH_OPTIONS { req.hdr(access-control-request-method) -m found } {{$p.Matcher}}{{end}}
+	use_backend {{$fe.Backend.Name}} if {{$fe.HostACL.Name}} {{$fe.PathACL.Name}}{{end}}{{range $nf := .NotFounds}}{{range $h := $nf.HostACLs}}
+	use_backend {{$nf.Name}} if {{$h}}{{end}}{{end}}
 
 	default_backend not_found
 
@@ -64,8 +92,64 @@ backend {{$be.Name}}
 	# Close connections after the proxy.
 	option http-server-close
 	# Include X-Forward-For header.
-	option forwardfor
+	option forwardfor{{if $be.TunnelTimeout}}
+	timeout tunnel {{$be.TunnelTimeout}}s{{end}}{{with $be.HealthCheck}}{{if .Path}}
+	option httpchk {{.Method}} {{.Path}}{{with $be.Host}} HTTP/1.1\r\nHost:\ {{.}}{{end}}{{if .Status}}
+	http-check expect status {{.Status}}{{end}}{{end}}{{end}}{{range $p := $be.ErrorPages}}
+	errorfile {{$p.Status}} {{$.Dir}}/{{$p.File}}{{end}}{{with $r := $be.ErrorRedirect}}
+	# Responses can't be replaced by another backend's, so errors are
+	# redirected to the error service. Only browsers asking for a page are,
+	# as other clients wouldn't follow the redirect, or would lose the
+	# status.
+	http-request set-var(txn.error_redirect) bool(true) if METH_GET { req.hdr(accept) -m sub -i text/html }
+	http-response redirect location {{$r.Path}}%[status]?request_id=%ID code 302 if { status {{$r.Codes}} } { var(txn.error_redirect) -m bool }{{if $r.Unavailable}}
+	http-request redirect location {{$r.Path}}503?request_id=%ID code 302 if { nbsrv eq 0 } { var(txn.error_redirect) -m bool }{{end}}{{end}}{{with $be.MissingService}}
+	# Service {{.}} doesn't exist yet.
+	http-request deny deny_status 503{{end}}{{range $r := $be.SourceRules}}
+	acl {{$r.Name}} src {{if $r.File}}-f {{$.Dir}}/{{$r.File}}{{else}}{{$r.CIDRs}}{{end}}
+	http-request deny if {{if $r.Allow}}!{{end}}{{$r.Name}}{{end}}{{if $be.SSLRedirect}}
+	http-request redirect scheme https code {{$be.SSLRedirect}} unless { ssl_fc } || { req.hdr(x-forwarded-proto) -i https }{{end}}{{with $be.RateLimit}}
+	stick-table type {{.Type}} size 100k expire 30s store http_req_rate(10s),conn_cur
+	http-request track-sc0 {{.Key}}{{if .Requests}}
+	http-request {{.Action}} deny_status {{.Status}} if { sc0_http_req_rate gt {{.Requests}} }{{end}}{{if .Connections}}
+	http-request {{.Action}} deny_status {{.Status}} if { sc0_conn_cur gt {{.Connections}} }{{end}}{{end}}{{with $be.Auth}}
+	http-request auth{{if .Realm}} realm {{.Realm}}{{end}} unless { http_auth({{.Userlist}}) }{{end}}{{if $be.Rewrite}}
+	http-request set-path %[path,regsub({{$be.Rewrite}})]{{end}}{{range $r := $be.HeaderRules}}
+	{{$r}}{{end}}{{with $be.Host}}
+	# The external host is reached by its own name.
+	http-request set-header Host {{.}}{{end}}{{if $be.HSTS}}
+	# Browsers ignore the header over plain HTTP, so it's always added.
+	http-response set-header Strict-Transport-Security "{{$be.HSTS}}"{{end}}{{with $be.CORS}}{{if .AnyOrigin}}
+	http-response set-header Access-Control-Allow-Origin "*"{{else}}
+	http-request set-var(txn.cors_origin) req.hdr(origin){{range $o := .Origins}}
+	http-response set-header Access-Control-Allow-Origin "{{$o}}" if { var(txn.cors_origin) -m str {{$o}} }{{end}}
+	http-response add-header Vary Origin{{end}}{{if .Credentials}}
+	http-response set-header Access-Control-Allow-Credentials "true"{{end}}{{end}}
+
+	balance {{if $be.Weighted}}roundrobin{{else}}leastconn{{end}}{{with $be.Affinity}}
+	cookie {{.Cookie}} insert indirect nocache{{if .MaxAge}} maxlife {{.MaxAge}}s{{end}}{{if .Persist}}
+	option persist
+	no option redispatch{{end}}{{end}}{{range $s := $be.Servers}}
+	server {{$s.Name}} {{$s.Address}} resolvers dns{{with $be.HealthCheck}} check{{if .Interval}} inter {{.Interval}}s{{end}}{{if .Rise}} rise {{.Rise}}{{end}}{{if .Fall}} fall {{.Fall}}{{end}}{{end}}{{if $be.Weighted}} weight {{$s.Weight}}{{end}}{{if $s.Cookie}} cookie {{$s.Cookie}}{{end}}{{with $s.SNI}} ssl verify required ca-file /etc/ssl/certs/ca-certificates.crt sni str({{.}}){{end}}{{end}}{{end}}{{ range $fe := .Frontends }}{{ range $p := $fe.Preflights }}
+
+backend {{$p.Backend}}
+	# Answered by HAProxy with the response in the errorfile.
+	http-request deny deny_status 200
+	errorfile 200 {{$.Dir}}/{{$p.File}}{{end}}{{end}}{{ range $nf := .NotFounds }}
+
+backend {{$nf.Name}}
+	errorfile 503 {{$.Dir}}/{{$nf.File}}{{end}}{{ range $t := .TCPServices }}
+
+frontend {{$t.Name}}
+	bind :{{$t.Port}}
+	mode tcp
+	option tcplog{{if $t.ClientTimeout}}
+	timeout client {{$t.ClientTimeout}}s{{end}}
+	default_backend {{$t.Name}}
 
-	balance leastconn
-	server {{$be.Server}} resolvers dns{{end}}
+backend {{$t.Name}}
+	mode tcp{{if $t.ServerTimeout}}
+	timeout server {{$t.ServerTimeout}}s{{end}}
+	timeout tunnel {{$t.TunnelTimeout}}s
+	server {{$t.Name}} {{$t.Address}} resolvers dns check{{with $t.SendProxy}} {{.}}{{end}}{{end}}
 `
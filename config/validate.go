@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// Everything from an ingress ends up in a config shared by every namespace, so
+// it's checked against what it can be before being rendered. Anything that
+// could be read by HAProxy as more than the one word it's meant to be, such as
+// whitespace, quotes, backslashes or "#", would let one ingress change the
+// routing of others, or fail the reload for everyone.
+var (
+	// Paths are kept to the characters allowed unencoded in a URL path.
+	validPath = regexp.MustCompile(`^/[A-Za-z0-9._~!&()*+,;=:@%/-]*$`)
+	// Namespaces are DNS labels, which unlike service names may start with
+	// a digit.
+	validNamespace = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// validateIngress returns why the ingress can't be rendered, if it can't.
+func validateIngress(i extensions.Ingress) error {
+	if !validNamespace.MatchString(i.Namespace) {
+		return fmt.Errorf("invalid namespace %q", i.Namespace)
+	}
+	if !validSubdomain.MatchString(i.Name) {
+		return fmt.Errorf("invalid name %q", i.Name)
+	}
+	return nil
+}
+
+// validatePath returns why the path can't be rendered, if it can't.
+func validatePath(path extensions.HTTPIngressPath) error {
+	if !validPath.MatchString(path.Path) {
+		return fmt.Errorf("invalid path %q", path.Path)
+	}
+	if !validServiceName.MatchString(path.Backend.ServiceName) {
+		return fmt.Errorf("invalid service name %q", path.Backend.ServiceName)
+	}
+	return validatePort(path.Backend.ServicePort)
+}
+
+// validatePort returns why the service port can't be rendered, if it can't.
+// Ports are numbers or names, which are IANA service names.
+func validatePort(port intstr.IntOrString) error {
+	switch port.Type {
+	case intstr.Int:
+		if port.IntVal <= 0 || port.IntVal > 65535 {
+			return fmt.Errorf("invalid service port %d", port.IntVal)
+		}
+	case intstr.String:
+		if len(port.StrVal) > 15 || !validServiceName.MatchString(port.StrVal) {
+			return fmt.Errorf("invalid service port %q", port.StrVal)
+		}
+	default:
+		return fmt.Errorf("invalid service port")
+	}
+	return nil
+}
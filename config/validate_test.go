@@ -0,0 +1,237 @@
+package config
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// fuzzAlphabet has the characters most likely to change how HAProxy reads a
+// line, along with some that are harmless.
+const fuzzAlphabet = "aZ09/. \t\n\r#'\"\\$%{}[]-_:,;=&?@!()*+~|^`<>é\x00"
+
+// fuzzFields are the fields of an ingress that users control, each with a
+// value that is rendered and a function setting it.
+var fuzzFields = []struct {
+	name, safe string
+	// multiline fields take a rule per line, so newlines are left out.
+	multiline bool
+	set       func(i *extensions.Ingress, v string)
+}{
+	{"namespace", "default", false, func(i *extensions.Ingress, v string) { i.Namespace = v }},
+	{"name", "foo", false, func(i *extensions.Ingress, v string) { i.Name = v }},
+	{"host", "foo", false, func(i *extensions.Ingress, v string) { i.Spec.Rules[0].Host = v }},
+	{"path", "/foo", false, func(i *extensions.Ingress, v string) { i.Spec.Rules[0].HTTP.Paths[0].Path = v }},
+	{"service", "foo", false, func(i *extensions.Ingress, v string) { i.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName = v }},
+	{"port", "http", false, func(i *extensions.Ingress, v string) {
+		i.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort = intstr.FromString(v)
+	}},
+	{"canary header", "X-Canary", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[canaryServiceAnnotation] = "foo-canary"
+		i.Annotations[canaryByHeaderAnnotation] = v
+	}},
+	{"canary header value", "always", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[canaryServiceAnnotation] = "foo-canary"
+		i.Annotations[canaryByHeaderAnnotation] = "X-Canary"
+		i.Annotations[canaryByHeaderValueAnnotation] = v
+	}},
+	{"canary cookie", "canary", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[canaryServiceAnnotation] = "foo-canary"
+		i.Annotations[canaryByCookieAnnotation] = v
+	}},
+	{"rewrite target", "/app", false, func(i *extensions.Ingress, v string) { i.Annotations[rewriteTargetAnnotation] = v }},
+	{"header name", "X-Foo", true, func(i *extensions.Ingress, v string) { i.Annotations[deleteRequestHeadersAnnotation] = v }},
+	{"header value", "bar", true, func(i *extensions.Ingress, v string) { i.Annotations[setRequestHeadersAnnotation] = "X-Foo: " + v }},
+	{"rate limit header", "X-Client", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[limitRequestRateAnnotation] = "10"
+		i.Annotations[limitByHeaderAnnotation] = v
+	}},
+	{"health check path", "/healthz", false, func(i *extensions.Ingress, v string) { i.Annotations[healthCheckPathAnnotation] = v }},
+	{"health check method", "HEAD", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[healthCheckPathAnnotation] = "/healthz"
+		i.Annotations[healthCheckMethodAnnotation] = v
+	}},
+	{"cors origin", "https://example.com", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[enableCORSAnnotation] = "true"
+		i.Annotations[corsAllowOriginAnnotation] = v
+	}},
+	{"error service", "errors:80", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[customHTTPErrorsAnnotation] = "502"
+		i.Annotations[errorServiceAnnotation] = v
+	}},
+	{"error codes", "502", false, func(i *extensions.Ingress, v string) {
+		i.Annotations[customHTTPErrorsAnnotation] = v
+		i.Annotations[errorServiceAnnotation] = "errors:80"
+	}},
+	{"tunnel timeout", "60", false, func(i *extensions.Ingress, v string) { i.Annotations[tunnelTimeoutAnnotation] = v }},
+}
+
+// TestRenderFuzz renders ingresses with random values in the fields users
+// control, checking that each either renders like a valid value, or is
+// rejected, and never changes the structure of the config.
+func TestRenderFuzz(t *testing.T) {
+	render := func(ingresses ...extensions.Ingress) string {
+		return renderConfig(t, ingresses, &fakeClient{}, Options{})
+	}
+
+	ingress := func(set func(*extensions.Ingress, string), v string) extensions.Ingress {
+		i := annotatedIngress(map[string]string{})
+		if set != nil {
+			set(&i, v)
+		}
+		return i
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, field := range fuzzFields {
+		// Rejected values leave the field's annotations ignored, the path
+		// or rule skipped, or the ingress skipped.
+		shapes := map[string]bool{
+			shape(render(ingress(field.set, field.safe))): true,
+			shape(render(ingress(nil, ""))):               true,
+			shape(render(ingress(func(i *extensions.Ingress, _ string) {
+				i.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName = "-"
+			}, ""))): true,
+			shape(render(ingress(func(i *extensions.Ingress, _ string) { i.Spec.Rules[0].Host = "-" }, ""))): true,
+			shape(render()): true,
+		}
+
+		for n := 0; n < 200; n++ {
+			v := fuzzValue(r, field.safe, field.multiline)
+			contents := render(ingress(field.set, v))
+			if !shapes[shape(contents)] {
+				t.Logf("config:\n%s", contents)
+				t.Fatalf("%s %q changed the structure of the config", field.name, v)
+			}
+		}
+	}
+}
+
+// fuzzValue returns a random value, often starting with the safe one to get
+// past checks on the start of it.
+func fuzzValue(r *rand.Rand, safe string, multiline bool) string {
+	var b []rune
+	if r.Intn(2) == 0 {
+		b = []rune(safe)
+	}
+
+	alphabet := []rune(fuzzAlphabet)
+	for n := r.Intn(8); n >= 0; n-- {
+		c := alphabet[r.Intn(len(alphabet))]
+		if multiline && (c == '\n' || c == '\r') {
+			continue
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// shape returns the words of the config as HAProxy reads them, other than
+// comments, with everything but the first word of each line replaced by "_".
+// Values only change the shape of a config if they're read as more, or less,
+// than one word.
+func shape(config string) string {
+	var lines []string
+	for _, line := range strings.Split(config, "\n") {
+		words := haproxyWords(line)
+		if len(words) == 0 {
+			continue
+		}
+
+		s := words[0]
+		for n := 1; n < len(words); n++ {
+			s += " _"
+		}
+		lines = append(lines, s)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// haproxyWords splits a config line into words the way HAProxy does, with
+// "'" and '"' quoting, "\" escaping outside single quotes and unquoted "#"
+// starting a comment. Anything HAProxy would expand or reject is returned as
+// a word of its own, so it changes the shape.
+func haproxyWords(line string) []string {
+	var words []string
+	var word []rune
+	inWord := false
+	var quote rune
+
+	for _, c := range line {
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+				continue
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+				continue
+			}
+			if c == '\\' || c == '$' {
+				words = append(words, "!expanded")
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+			continue
+		case c == '\\':
+			words = append(words, "!escaped")
+		case c == '#':
+			if inWord {
+				words = append(words, string(word))
+			}
+			return append(words, "!comment")
+		case c == ' ' || c == '\t' || c == '\r':
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = nil, false
+			}
+			continue
+		}
+
+		word = append(word, c)
+		inWord = true
+	}
+
+	if quote != 0 {
+		words = append(words, "!unterminated")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+func TestValidatePath(t *testing.T) {
+	valid := extensions.HTTPIngressPath{
+		Path:    "/api/v1;type=a",
+		Backend: extensions.IngressBackend{ServiceName: "foo", ServicePort: intstr.FromString("http")},
+	}
+	if err := validatePath(valid); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		set  func(*extensions.HTTPIngressPath)
+	}{
+		{"space in path", func(p *extensions.HTTPIngressPath) { p.Path = "/ if TRUE" }},
+		{"comment in path", func(p *extensions.HTTPIngressPath) { p.Path = "/#" }},
+		{"newline in path", func(p *extensions.HTTPIngressPath) { p.Path = "/\nbackend evil" }},
+		{"relative path", func(p *extensions.HTTPIngressPath) { p.Path = "api" }},
+		{"service name", func(p *extensions.HTTPIngressPath) { p.Backend.ServiceName = "foo bar" }},
+		{"named port", func(p *extensions.HTTPIngressPath) { p.Backend.ServicePort = intstr.FromString("http check") }},
+		{"numbered port", func(p *extensions.HTTPIngressPath) { p.Backend.ServicePort = intstr.FromInt(70000) }},
+	} {
+		p := valid
+		test.set(&p)
+		if err := validatePath(p); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
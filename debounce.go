@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hing_reloads_total",
+		Help: "Number of times HAProxy has been reloaded with a new config.",
+	})
+	coalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hing_coalesced_changes_total",
+		Help: "Number of ingress changes folded into a reload for an earlier change.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloads)
+	prometheus.MustRegister(coalesced)
+}
+
+// debouncer collects bursts of changes into a single reload. A reload waits
+// until there have been no changes for debounce and at least minInterval has
+// passed since the last one, unless the oldest pending change has already
+// waited maxDelay.
+type debouncer struct {
+	debounce, minInterval, maxDelay time.Duration
+
+	// pending is the number of changes since the last reload, the first of
+	// which was seen at first and the latest at last.
+	pending     int
+	first, last time.Time
+	reloaded    time.Time
+}
+
+// changed records a change seen at now.
+func (d *debouncer) changed(now time.Time) {
+	if d.pending == 0 {
+		d.first = now
+	}
+	d.pending++
+	d.last = now
+}
+
+// ready reports whether the pending changes should be reloaded at now.
+func (d *debouncer) ready(now time.Time) bool {
+	if d.pending == 0 {
+		return false
+	}
+
+	if now.Sub(d.first) >= d.maxDelay {
+		return true
+	}
+
+	return now.Sub(d.last) >= d.debounce && now.Sub(d.reloaded) >= d.minInterval
+}
+
+// reload records a reload at now, returning the number of changes it covers.
+func (d *debouncer) reload(now time.Time) int {
+	n := d.pending
+	d.pending = 0
+	d.reloaded = now
+
+	reloads.Inc()
+	coalesced.Add(float64(n - 1))
+	return n
+}
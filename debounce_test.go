@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	tests := []struct {
+		name    string
+		d       debouncer
+		changes []time.Duration
+		// ready is the earliest time after the last change that a reload
+		// is allowed.
+		ready time.Duration
+	}{
+		{
+			name:    "no debounce",
+			d:       debouncer{maxDelay: time.Minute},
+			changes: []time.Duration{0},
+			ready:   0,
+		},
+		{
+			name:    "quiet period",
+			d:       debouncer{debounce: 2 * time.Second, maxDelay: time.Minute},
+			changes: []time.Duration{0, time.Second, 3 * time.Second},
+			ready:   5 * time.Second,
+		},
+		{
+			name:    "min interval",
+			d:       debouncer{minInterval: 10 * time.Second, maxDelay: time.Minute, reloaded: at(-5 * time.Second)},
+			changes: []time.Duration{0},
+			ready:   5 * time.Second,
+		},
+		{
+			name:    "quiet period past min interval",
+			d:       debouncer{debounce: 8 * time.Second, minInterval: 10 * time.Second, maxDelay: time.Minute, reloaded: at(-5 * time.Second)},
+			changes: []time.Duration{0},
+			ready:   8 * time.Second,
+		},
+		{
+			name:    "max delay",
+			d:       debouncer{debounce: 2 * time.Second, maxDelay: 5 * time.Second},
+			changes: []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+			ready:   5 * time.Second,
+		},
+		{
+			name:    "max delay over min interval",
+			d:       debouncer{minInterval: time.Hour, maxDelay: 5 * time.Second, reloaded: at(0)},
+			changes: []time.Duration{time.Second},
+			ready:   6 * time.Second,
+		},
+	}
+
+	for i, test := range tests {
+		d := test.d
+		if d.ready(at(0)) {
+			t.Errorf("%d: %s: ready without changes", i+1, test.name)
+		}
+
+		for _, c := range test.changes {
+			d.changed(at(c))
+		}
+
+		if d.ready(at(test.ready - time.Millisecond)) {
+			t.Errorf("%d: %s: ready before %v", i+1, test.name, test.ready)
+		}
+		if !d.ready(at(test.ready)) {
+			t.Errorf("%d: %s: not ready at %v", i+1, test.name, test.ready)
+		}
+
+		if n := d.reload(at(test.ready)); n != len(test.changes) {
+			t.Errorf("%d: %s: expected %d coalesced changes, got %d", i+1, test.name, len(test.changes), n)
+		}
+		if d.ready(at(test.ready + time.Hour)) {
+			t.Errorf("%d: %s: ready after reload without changes", i+1, test.name)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// socket is the admin socket rendered into the config in master-worker mode.
+// New workers fetch the listening sockets of the old ones through it.
+const socket = "/var/run/haproxy.sock"
+
+// haproxy manages the HAProxy process(es) serving the rendered config.
+type haproxy struct {
+	config, pidfile string
+	reaper          *reaper
+
+	// masterWorker runs HAProxy with -W and reloads it by sending SIGUSR2 to
+	// the master, which hands the listeners over to the new workers. When
+	// false a new process is started with -sf for every reload, which works
+	// with binaries older than 1.8.
+	masterWorker bool
+
+	// mu serializes reloads with stop.
+	mu sync.Mutex
+
+	// pmu guards the process state below, which is also used by exited.
+	pmu sync.Mutex
+	// pid is the process serving the current config, or 0 while it's being
+	// replaced.
+	pid int
+	// stopped prevents further reloads and makes the exit of pid expected.
+	stopped bool
+	// stopping is closed when pid exits after stop.
+	stopping chan struct{}
+}
+
+func newHaproxy(config, pidfile string, masterWorker bool) *haproxy {
+	h := &haproxy{
+		config:       config,
+		pidfile:      pidfile,
+		masterWorker: masterWorker,
+	}
+	h.reaper = &reaper{exited: h.exited}
+	return h
+}
+
+func (h *haproxy) reload() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.isStopped() {
+		log.Print("haproxy is stopping, skipping reload")
+		return
+	}
+
+	if h.masterWorker {
+		h.reloadMasterWorker()
+		return
+	}
+
+	h.reloadSoftFinish()
+}
+
+func (h *haproxy) reloadSoftFinish() {
+	pid, err := ioutil.ReadFile(h.pidfile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("error reading pidfile: %v", err)
+	}
+
+	args := []string{"-f", h.config, "-p", h.pidfile}
+	if string(pid) != "" {
+		// The old process exits once its connections finish, which may
+		// be before the new one has written the pidfile.
+		h.setPid(0)
+		args = append(args, "-sf", string(pid))
+	}
+
+	h.run(args...)
+	waitForChange(string(pid), h.pidfile)
+	h.setPid(readPid(h.pidfile))
+}
+
+func (h *haproxy) reloadMasterWorker() {
+	pid, err := ioutil.ReadFile(h.pidfile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("error reading pidfile: %v", err)
+	}
+
+	if string(pid) == "" {
+		// The socket doesn't exist on the first start; HAProxy warns and
+		// binds the listeners itself.
+		h.run("-W", "-f", h.config, "-p", h.pidfile, "-x", socket)
+		waitForChange("", h.pidfile)
+		h.setPid(readPid(h.pidfile))
+		return
+	}
+
+	// The master keeps the old workers running if the new config is
+	// invalid, so check it first rather than reloading into nothing.
+	h.run("-c", "-f", h.config)
+
+	master := readPid(h.pidfile)
+	log.Printf("signalling haproxy master %d to reload", master)
+	if err := syscall.Kill(master, syscall.SIGUSR2); err != nil {
+		log.Fatalf("failed to signal haproxy master: %v", err)
+	}
+}
+
+// stop soft stops HAProxy so that it closes its listeners and exits once open
+// connections have finished. If it's still running after timeout it is
+// stopped immediately.
+func (h *haproxy) stop(timeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.pmu.Lock()
+	h.stopped = true
+	pid := h.pid
+	stopping := make(chan struct{})
+	h.stopping = stopping
+	h.pmu.Unlock()
+
+	if pid == 0 {
+		log.Print("haproxy not running")
+		return
+	}
+
+	// In master-worker mode the master passes the signal on to its workers
+	// and exits after them.
+	log.Printf("soft stopping haproxy %d", pid)
+	if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+		log.Printf("failed to soft stop haproxy: %v", err)
+		return
+	}
+
+	select {
+	case <-stopping:
+		log.Printf("haproxy %d exited", pid)
+	case <-time.After(timeout):
+		log.Printf("haproxy %d still running after %s, stopping it", pid, timeout)
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+}
+
+// exited is called by the reaper with the status of every child that exits.
+// HAProxy exiting on its own leaves nothing serving the config, so hing exits
+// too and is restarted.
+func (h *haproxy) exited(pid int, ws syscall.WaitStatus) {
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+
+	if pid != h.pid {
+		log.Printf("reaped process %d: %s", pid, describe(ws))
+		return
+	}
+
+	if !h.stopped {
+		log.Fatalf("haproxy %d exited unexpectedly: %s", pid, describe(ws))
+	}
+
+	log.Printf("haproxy %d stopped: %s", pid, describe(ws))
+	close(h.stopping)
+	h.pid = 0
+}
+
+func (h *haproxy) setPid(pid int) {
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+
+	h.pid = pid
+	if pid == 0 {
+		return
+	}
+
+	// It may have exited before the pid was known, and so not been
+	// recognised by exited.
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		log.Fatalf("haproxy %d exited on startup", pid)
+	}
+}
+
+func (h *haproxy) isStopped() bool {
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+
+	return h.stopped
+}
+
+// run runs haproxy with the given args, exiting if it fails.
+func (h *haproxy) run(args ...string) {
+	out, err := h.reaper.run("haproxy", args...)
+	if err != nil {
+		log.Printf("ran command: %s", strings.Join(append([]string{"haproxy"}, args...), " "))
+		log.Printf("output when restarting:\n%s", string(out))
+		log.Fatalf("failed to reload haproxy: %v", err)
+	}
+}
+
+func waitForChange(oldPid, pidfile string) {
+	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
+
+	after := time.After(30 * time.Second)
+
+	for {
+		select {
+		case <-after:
+			log.Fatal("haproxy failed to change pid within 30s")
+		case <-t.C:
+			pid, err := ioutil.ReadFile(pidfile)
+			if err != nil {
+				continue
+			}
+
+			if string(pid) != oldPid {
+				return
+			}
+		}
+	}
+}
+
+func readPid(pidfile string) int {
+	spid, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		log.Fatalf("error reading pidfile: %v", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSuffix(string(spid), "\n"))
+	if err != nil {
+		log.Fatalf("failed to parse pid %s: %v", spid, err)
+	}
+	return pid
+}
+
+func describe(ws syscall.WaitStatus) string {
+	if ws.Signaled() {
+		return "killed by " + ws.Signal().String()
+	}
+	return "exit status " + strconv.Itoa(ws.ExitStatus())
+}
@@ -1,139 +1,167 @@
 package main
 
 import (
-	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/macb/hing/config"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/kubernetes/pkg/api"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/util"
 )
 
-func reloadHaproxy(config, pidfile string) {
-	pid, err := ioutil.ReadFile(pidfile)
-	if err != nil && !os.IsNotExist(err) {
-		log.Fatalf("error reading pidfile: %v", err)
-	}
+// shutdown waits for a signal to stop, then marks hing not ready and waits for
+// drain so that it is removed from service endpoints before HAProxy is soft
+// stopped. HAProxy is given up to timeout to finish open connections.
+func shutdown(sigs <-chan os.Signal, h *haproxy, st *status, drain, timeout time.Duration) {
+	sig := <-sigs
+	log.Printf("received %s, draining for %s", sig, drain)
+	st.setReady(false)
+	time.Sleep(drain)
+
+	h.stop(timeout)
+	log.Print("shut down")
+	os.Exit(0)
+}
 
-	args := []string{"-f", config, "-p", pidfile}
-	if string(pid) != "" {
-		go reapProcess(string(pid))
-		args = append(args, "-sf", string(pid))
+// envDuration returns the duration in the named environment variable, or def
+// if it isn't set.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
 	}
 
-	out, err := exec.Command("haproxy", args...).CombinedOutput()
-	if err != nil && err.Error() != "wait: no child processes" {
-		log.Printf("ran command: %s", strings.Join(append([]string{"haproxy"}, args...), " "))
-		log.Printf("output when restarting:\n%s", string(out))
-		log.Fatalf("failed to reload haproxy: %v", err)
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v.", name, err)
 	}
-
-	waitForChange(string(pid), pidfile)
+	return d
 }
 
-func waitForChange(oldPid, pidfile string) {
-	t := time.NewTicker(1 * time.Second)
-	defer t.Stop()
+func main() {
+	path := "/etc/haproxy/haproxy.cfg"
+	pidfile := "/var/run/haproxy.pid"
 
-	after := time.After(30 * time.Second)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 
-	for {
-		select {
-		case <-after:
-			log.Fatal("haproxy failed to change pid within 30s")
-		case <-t.C:
-			pid, err := ioutil.ReadFile(pidfile)
-			if err != nil {
-				continue
-			}
-
-			if string(pid) != oldPid {
-				return
-			}
-		}
+	statusAddr := os.Getenv("STATUS_ADDR")
+	if statusAddr == "" {
+		statusAddr = ":8080"
 	}
-}
-
-func reapProcess(spid string) {
-	pid, err := strconv.Atoi(strings.TrimSuffix(spid, "\n"))
+	_, port, err := net.SplitHostPort(statusAddr)
 	if err != nil {
-		log.Fatalf("failed to parse pid %s: %v", spid, err)
+		log.Fatalf("invalid STATUS_ADDR: %v.", err)
 	}
+	statusPort, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatalf("invalid STATUS_ADDR port %q.", port)
+	}
+	st := &status{}
+	http.Handle("/healthz", st)
+	http.Handle("/metrics", prometheus.Handler())
+	go func() {
+		log.Fatal(http.ListenAndServe(statusAddr, nil))
+	}()
+
+	kubeclient, err := client.NewInCluster()
+	if err != nil {
+		log.Fatalf("failed to create client: %v.", err)
+	}
+	ingclient := kubeclient.Extensions().Ingress(api.NamespaceAll)
 
-	log.Printf("reaping process %d", pid)
-	for {
-		p, err := syscall.Wait4(pid, nil, 0, nil)
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("failed to get hostname: %v.", err)
+	}
 
+	var masterWorker bool
+	if mw := os.Getenv("HAPROXY_MASTER_WORKER"); mw != "" {
+		masterWorker, err = strconv.ParseBool(mw)
 		if err != nil {
-			if err == syscall.ECHILD {
-				break
-			}
-			log.Fatalf("unexpected error when waiting: %v", err)
-		}
-
-		switch p {
-		case 0:
-			// There are more PIDs to reap.
-			log.Print("waiting to reap more processes")
-		case -1:
-			log.Fatalf("unexpected pid value when waiting: %d", p)
-		default:
-			log.Printf("reaped process %d", p)
-			return
+			log.Fatalf("invalid HAPROXY_MASTER_WORKER: %v.", err)
 		}
 	}
-}
-
-func main() {
-	path := "/etc/haproxy/haproxy.cfg"
-	pidfile := "/var/run/haproxy.pid"
-	var ingclient client.IngressInterface
 
-	if kubeclient, err := client.NewInCluster(); err != nil {
-		log.Fatalf("failed to create client: %v.", err)
+	var nameservers []string
+	if ns := os.Getenv("NAMESERVERS"); ns != "" {
+		nameservers, err = config.ParseNameservers(ns)
 	} else {
-		ingclient = kubeclient.Extensions().Ingress(api.NamespaceAll)
+		nameservers, err = config.ReadNameservers("/etc/resolv.conf")
 	}
-
-	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("failed to get hostname: %v.", err)
+		log.Fatalf("failed to get nameservers: %v.", err)
 	}
-	c := config.NewConfig(ingclient, hostname, path, os.Getenv("BASE_DOMAIN"))
+
+	h := newHaproxy(path, pidfile, masterWorker)
+	h.reaper.start()
+
+	c := config.NewConfig(ingclient, kubeclient, hostname, path, os.Getenv("BASE_DOMAIN"), config.Options{
+		MasterWorker:    masterWorker,
+		TunnelTimeout:   envDuration("TUNNEL_TIMEOUT", time.Hour),
+		TCPServices:     os.Getenv("TCP_SERVICES_CONFIGMAP"),
+		StatusPort:      statusPort,
+		ErrorPages:      os.Getenv("ERROR_PAGES_CONFIGMAP"),
+		ClusterDomain:   os.Getenv("CLUSTER_DOMAIN"),
+		Nameservers:     nameservers,
+		ResolverHold:    envDuration("RESOLVER_HOLD", 10*time.Second),
+		ResolverTimeout: envDuration("RESOLVER_TIMEOUT", time.Second),
+	})
 	_, err = c.Update()
 	if err != nil {
 		log.Fatalf("failed to create conf: %v", err)
 	}
 
-	reloadHaproxy(path, pidfile)
+	h.reload()
+	st.setReady(true)
+
+	go shutdown(sigs, h, st, envDuration("DRAIN_PERIOD", 10*time.Second), envDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+
+	d := &debouncer{
+		debounce:    envDuration("RELOAD_DEBOUNCE", 0),
+		minInterval: envDuration("RELOAD_MIN_INTERVAL", 0),
+		maxDelay:    envDuration("RELOAD_MAX_DELAY", time.Minute),
+		reloaded:    time.Now(),
+	}
 
 	// controller loop
 	ratelimiter := util.NewTokenBucketRateLimiter(0.1, 1)
 	for {
 		ratelimiter.Accept()
-		changed, err := c.Update()
+		changed, err := c.Fetch()
 		if err != nil {
-			switch err.(type) {
-			case config.ListError:
-				log.Printf("failed to list ingresses: %s", err.Error())
-				continue
-			default:
-				log.Fatalf("failed to update file: %v", err)
-			}
+			log.Printf("failed to fetch ingresses: %s", err.Error())
+			continue
 		}
 
+		now := time.Now()
 		if changed {
-			log.Print("reloading haproxy")
-			reloadHaproxy(path, pidfile)
-		} else {
+			d.changed(now)
+		}
+
+		if d.pending == 0 {
 			log.Print("haproxy config unchanged")
+			continue
 		}
+
+		if !d.ready(now) {
+			log.Printf("delaying reload for %d changes", d.pending)
+			continue
+		}
+
+		if err := c.Render(); err != nil {
+			log.Fatalf("failed to update file: %v", err)
+		}
+
+		log.Printf("reloading haproxy for %d coalesced changes", d.reload(now))
+		h.reload()
 	}
 }
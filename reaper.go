@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from linux/prctl.h, which the
+// syscall package doesn't define.
+const prSetChildSubreaper = 36
+
+// reaper waits on every child process that exits. HAProxy daemonizes, so its
+// processes are reparented to hing, as is any other orphaned descendant when
+// hing runs as PID 1. Exit statuses are passed to exited.
+type reaper struct {
+	exited func(pid int, ws syscall.WaitStatus)
+
+	// mu is held for reading while a command runs so that its status is
+	// collected by exec rather than taken by the reaper.
+	mu sync.RWMutex
+}
+
+// start reaps children as they exit. When hing isn't PID 1 it becomes a
+// subreaper so that HAProxy is still reparented to it.
+func (r *reaper) start() {
+	if os.Getpid() != 1 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+		if errno != 0 {
+			log.Fatalf("failed to become a subreaper: %v", errno)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	go func() {
+		for range sigs {
+			r.reap()
+		}
+	}()
+}
+
+// reap waits on every child that has exited. SIGCHLD isn't queued, so one
+// signal may stand for any number of exits.
+func (r *reaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+
+		r.exited(pid, ws)
+	}
+}
+
+// run runs the named command, returning its combined output.
+func (r *reaper) run(name string, args ...string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return exec.Command(name, args...).CombinedOutput()
+}
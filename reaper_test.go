@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var (
+	// The reaper handles SIGCHLD for the whole process, so the tests share
+	// one and swap what it passes exits to.
+	testReaper     = &reaper{}
+	testReaperOnce sync.Once
+	exitedMu       sync.Mutex
+	exitedFunc     func(pid int, ws syscall.WaitStatus)
+)
+
+// startReaper starts the shared reaper, passing exits to exited.
+func startReaper(exited func(pid int, ws syscall.WaitStatus)) *reaper {
+	exitedMu.Lock()
+	exitedFunc = exited
+	exitedMu.Unlock()
+
+	testReaperOnce.Do(func() {
+		testReaper.exited = func(pid int, ws syscall.WaitStatus) {
+			exitedMu.Lock()
+			defer exitedMu.Unlock()
+			exitedFunc(pid, ws)
+		}
+		testReaper.start()
+	})
+	return testReaper
+}
+
+// orphans runs a shell that starts n background sleeps and exits without
+// waiting on them, returning their pids.
+func orphans(t *testing.T, r *reaper, n int, sleep string) []int {
+	// The sleeps don't hold on to the output, which run waits to be closed.
+	script := "for i in $(seq " + strconv.Itoa(n) + "); do sleep " + sleep + " >/dev/null 2>&1 & echo $!; done"
+	out, err := r.run("sh", "-c", script)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var pids []int
+	for _, f := range strings.Fields(string(out)) {
+		pid, err := strconv.Atoi(f)
+		if err != nil {
+			t.Fatalf("unexpected output %q", out)
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func TestReaperReapsOrphans(t *testing.T) {
+	reaped := make(chan int, 100)
+	r := startReaper(func(pid int, ws syscall.WaitStatus) {
+		reaped <- pid
+	})
+
+	pids := orphans(t, r, 5, "0")
+
+	pending := map[int]bool{}
+	for _, pid := range pids {
+		pending[pid] = true
+	}
+
+	timeout := time.After(5 * time.Second)
+	for len(pending) > 0 {
+		select {
+		case pid := <-reaped:
+			// Orphans of other tests may still be exiting.
+			delete(pending, pid)
+		case <-timeout:
+			t.Fatalf("processes %v weren't reaped", pending)
+		}
+	}
+}
+
+func TestReaperLeavesRunStatus(t *testing.T) {
+	reaped := make(chan int, 100)
+	r := startReaper(func(pid int, ws syscall.WaitStatus) {
+		reaped <- pid
+	})
+
+	// Orphans exiting while commands run signal the reaper, which must
+	// still leave the commands' statuses to exec.
+	for i := 0; i < 20; i++ {
+		orphans(t, r, 2, "0")
+
+		_, err := r.run("sh", "-c", "exit 3")
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("%d: expected exit error, got %v", i+1, err)
+		}
+		if status := exitErr.Sys().(syscall.WaitStatus).ExitStatus(); status != 3 {
+			t.Fatalf("%d: expected exit status 3, got %d", i+1, status)
+		}
+	}
+}
+
+func TestHaproxyStop(t *testing.T) {
+	h := newHaproxy("", "", false)
+	h.reaper = startReaper(h.exited)
+
+	// A sleep stands in for HAProxy, which daemonizes and so isn't waited on
+	// by the command that started it.
+	pid := orphans(t, h.reaper, 1, "10")[0]
+	h.setPid(pid)
+
+	done := make(chan struct{})
+	go func() {
+		h.stop(5 * time.Second)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(4 * time.Second):
+		t.Fatal("stop didn't return once haproxy exited")
+	}
+
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+	if h.pid != 0 {
+		t.Errorf("expected pid to be cleared, got %d", h.pid)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// status reports whether hing should receive traffic. It is not ready until
+// HAProxy has first started and stops being ready as soon as it begins
+// shutting down, so endpoints are removed before the listeners close.
+type status struct {
+	ready int32
+}
+
+func (s *status) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}